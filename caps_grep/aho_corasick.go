@@ -0,0 +1,138 @@
+package main
+
+// automata with up to this many states get a full transition table of 1 KiB a state, which is 4 MiB at
+// most, so matching never has to follow failure links. Bigger ones keep a full table for the root only.
+const denseStateLimit = 4096
+
+// Aho-Corasick automaton used to find every one of the search strings in a single pass over the data
+type ahoCorasick struct {
+	patterns []string
+	maxLen   int          // length of the longest pattern
+	edges    [][]acEdge   // transitions of the trie out of each state, sorted by byte
+	failure  []int32      // state for the longest proper suffix of each state that is in the trie
+	next     [][256]int32 // full transition table of the first len(next) states, see denseStateLimit
+	outputs  [][]int      // indices of the patterns that end in each state
+}
+
+// a transition of the trie
+type acEdge struct {
+	b      byte
+	target int32
+}
+
+// build the automaton for the given patterns, empty patterns never match
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	ac := &ahoCorasick{patterns: patterns}
+	ac.addState()
+
+	// build the trie of all the patterns
+	for patternIdx, pattern := range patterns {
+		if len(pattern) == 0 {
+			continue
+		}
+		if len(pattern) > ac.maxLen {
+			ac.maxLen = len(pattern)
+		}
+		var state int32
+		for i := 0; i < len(pattern); i++ {
+			child, found := ac.edge(state, pattern[i])
+			if false == found {
+				child = ac.addEdge(state, pattern[i])
+			}
+			state = child
+		}
+		ac.outputs[state] = append(ac.outputs[state], patternIdx)
+	}
+
+	// the root goes back to itself on any byte that starts no pattern
+	ac.next = make([][256]int32, 1)
+	for _, e := range ac.edges[0] {
+		ac.next[0][e.b] = e.target
+	}
+
+	// walk the trie breadth first to work out the failure links, the failure state of a state is
+	// always nearer the root so it is known by the time it is needed
+	ac.failure = make([]int32, len(ac.edges))
+	order := []int32{}
+	for _, e := range ac.edges[0] {
+		order = append(order, e.target)
+	}
+	for i := 0; i < len(order); i++ {
+		state := order[i]
+		for _, e := range ac.edges[state] {
+			ac.failure[e.target] = ac.step(ac.failure[state], e.b)
+			ac.outputs[e.target] = append(ac.outputs[e.target], ac.outputs[ac.failure[e.target]]...)
+			order = append(order, e.target)
+		}
+	}
+
+	// small automata get the full table, filling in the missing transitions of each state with those
+	// of its failure state
+	if len(ac.edges) <= denseStateLimit {
+		root := ac.next[0]
+		ac.next = make([][256]int32, len(ac.edges))
+		ac.next[0] = root
+		for _, state := range order {
+			ac.next[state] = ac.next[ac.failure[state]]
+			for _, e := range ac.edges[state] {
+				ac.next[state][e.b] = e.target
+			}
+		}
+	}
+
+	return ac
+}
+
+// the state the automaton moves to from "state" on reading b, states without a full table follow
+// their failure links until one has a transition for b or the root is reached
+func (ac *ahoCorasick) step(state int32, b byte) int32 {
+	for int(state) >= len(ac.next) {
+		if target, found := ac.edge(state, b); found {
+			return target
+		}
+		state = ac.failure[state]
+	}
+	return ac.next[state][b]
+}
+
+// find the transition of the trie out of "state" on b
+func (ac *ahoCorasick) edge(state int32, b byte) (int32, bool) {
+	edges := ac.edges[state]
+	low, high := 0, len(edges)
+	for low < high {
+		mid := (low + high) / 2
+		if edges[mid].b < b {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	if low < len(edges) && edges[low].b == b {
+		return edges[low].target, true
+	}
+	return 0, false
+}
+
+// add a new state to the trie reached from "state" on b and return its index
+func (ac *ahoCorasick) addEdge(state int32, b byte) int32 {
+	target := ac.addState()
+	edges := ac.edges[state]
+
+	pos := len(edges)
+	for pos > 0 && edges[pos-1].b > b {
+		pos--
+	}
+	edges = append(edges, acEdge{})
+	copy(edges[pos+1:], edges[pos:])
+	edges[pos] = acEdge{b, target}
+
+	ac.edges[state] = edges
+	return target
+}
+
+// add a new state with no transitions and return its index
+func (ac *ahoCorasick) addState() int32 {
+	ac.edges = append(ac.edges, nil)
+	ac.outputs = append(ac.outputs, nil)
+	return int32(len(ac.edges) - 1)
+}
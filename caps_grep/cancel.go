@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+)
+
+var timeoutFlag time.Duration
+
+// the context searches run under, it is cancelled once -timeout has passed or on the first interrupt,
+// after which a second interrupt ends the program straight away
+func newSearchContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if timeoutFlag <= 0 {
+		return ctx, stop
+	}
+
+	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, timeoutFlag)
+	return timeoutCtx, func() {
+		cancelTimeout()
+		stop()
+	}
+}
+
+// why the search was stopped before it finished, empty if it was not
+func cancelReason(ctx context.Context) string {
+	switch ctx.Err() {
+	case nil:
+		return ""
+	case context.DeadlineExceeded:
+		return "timed out"
+	default:
+		return "interrupted"
+	}
+}
+
+// reader that stops waiting for data once the context is cancelled, for readers such as standard input
+// that can block forever. A read that is given up on finishes in the background into its own buffer.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	resultChan := make(chan readResult, 1)
+	go func() {
+		buffer := make([]byte, len(p))
+		n, err := r.reader.Read(buffer)
+		resultChan <- readResult{buffer[:n], err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		return copy(p, result.data), result.err
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
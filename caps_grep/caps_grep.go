@@ -2,14 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
-	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 func check(e error) {
@@ -22,16 +30,146 @@ func check(e error) {
 type empty struct{}
 type semaphore chan empty
 
+// a file to search handed to a worker, "seq" is its place in the order the files were found
+type fileJob struct {
+	path string
+	seq  int64
+}
+
+// the record of a job sent to the aggregator, every job has exactly one however it ended, so results can be
+// put back in the order the files were found. The walk also sends its errors as records that are not jobs.
+type jobResult struct {
+	seq      int64        // the seq of the job, -1 for an error found while walking
+	result   FileResult   // results of the file, only set if it was searched
+	searched bool         // false if the file was not searched, so there is nothing to show for it
+	err      *SearchError // the file, or folder on the walk, that could not be searched
+}
+
+// the record of a file or folder that the walk could not look at
+func walkErrorResult(path string, err error) jobResult {
+	searchErr := newSearchError(path, err)
+	return jobResult{seq: -1, err: &searchErr}
+}
+
+// a single occurrence of the search string within a file
+type Match struct {
+	Path       string // path of the file the match was found in
+	Line       int64  // line number of the match
+	Column     int64  // byte position of the match within its line, starting at 1
+	RuneColumn int64  // character position of the match within its line, starting at 1
+	Pattern    string // the search string that matched
+	PatternIdx int    // index of the search string that matched in searchPatterns
+	Offset     int64  // byte offset of the match from the start of the file
+	LineText   string // text of the line the match was found on
+}
+
+// a line shown around the matches to give them context
+type ContextLine struct {
+	Line int64
+	Text string
+}
+
+// the outcome of searching a single file
+type FileResult struct {
+	Path          string
+	Matches       []Match
+	Occurrences   int64
+	PatternCounts []int64       // occurrences of each search string, in the order they were given
+	Context       []ContextLine // lines around the matches that did not match themselves, in line order
+	CharCount     int64
+	Binary        bool   // the file looked binary, so it was skipped or only counted depending on -binary
+	ReadMethod    string // how the file was searched, "read" in blocks or "mmap" when memory mapped
+}
+
+// a file or folder that could not be searched, the search carries on without it
+type SearchError struct {
+	Path   string
+	Reason string // why it could not be searched, such as "permission denied"
+}
+
+func newSearchError(path string, err error) SearchError {
+	reason := err.Error()
+	if pathErr, ok := err.(*os.PathError); ok {
+		reason = pathErr.Err.Error()
+	}
+
+	// opening a link to a file that is not there looks the same as the file not being there
+	if os.IsNotExist(err) {
+		if linkInfo, linkErr := os.Lstat(path); linkErr == nil && linkInfo.Mode()&os.ModeSymlink != 0 {
+			reason = "broken symbolic link"
+		}
+	}
+
+	return SearchError{Path: path, Reason: reason}
+}
+
+// flag that can be given more than once, collecting every value
+type stringListFlag []string
+
+func (l *stringListFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringListFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 var typeFlag string
-var searchStrFlag string
+var searchStrFlags stringListFlag
+var patternsFileFlag string
 var verboseFlag bool
 var methodFLag string
 var progressFlag bool
 var fileMapFlag bool
+var regexFlag bool
+var ignoreCaseFlag bool
+var wordFlag bool
+var afterContextFlag int
+var beforeContextFlag int
+var contextFlag int
+var formatFlag string
+var maxCountFlag int64
+var filesWithMatchesFlag bool
+var filesWithoutMatchesFlag bool
+var quietFlag bool
+var sortFlag string
 
 var cpuCount int
 var fileName string
 var cpuCountFlag int
+var workerCountFlag int
+var searchPatterns []string
+var searchAutomaton *ahoCorasick
+var searchRegexes []*regexp.Regexp
+var afterContext int64
+var binaryFlag string
+var mmapThresholdFlag int64
+
+// the amount of the start of a file that is looked at to decide if it is binary
+const binarySniffLen = 8000
+
+// the size of the buffers files are read into, a line longer than this makes the buffer grow
+const readBufferSize = 64 * 1024
+
+// the amount of a memory mapped file searched between checks that the search has not been cancelled
+const memoryStrideSize = 4 * 1024 * 1024
+
+var beforeContext int64
+
+// the most jobs -sort=path hands out ahead of the earliest file whose results have not been shown,
+// which limits the results held back waiting for it
+const reorderWindowSize = 256
+
+// the number of occurrences after which the search of a file stops, -1 for no limit
+var fileMatchLimit int64 = -1
+
+// exit status of the program, as grep uses them
+const (
+	exitMatches   = 0 // at least one match was found
+	exitNoMatches = 1 // everything was searched but nothing matched
+	exitErrors    = 2 // the arguments were wrong or some files could not be searched
+)
 
 func main() {
 
@@ -45,72 +183,304 @@ func main() {
 	} else {
 		cpuCount = cpuCountFlag
 	}
-	fmt.Print(fmt.Sprintf("Using %d cpus\n", cpuCount))
 	runtime.GOMAXPROCS(cpuCount)
 
-	if len(flag.Args()) == 0 {
+	switch formatFlag {
+	case "text":
+		if false == quietFlag && false == filesWithMatchesFlag && false == filesWithoutMatchesFlag {
+			fmt.Print(fmt.Sprintf("Using %d cpus\n", cpuCount))
+		}
+	case "json", "jsonl":
+		if methodFLag == "bench" {
+			fmt.Print(fmt.Sprintf("-format=%s can not be used with -method=bench\n", formatFlag))
+			os.Exit(exitErrors)
+		}
+	default:
+		fmt.Print(fmt.Sprintf("unknown format \"%s\", use text, json or jsonl\n", formatFlag))
+		os.Exit(exitErrors)
+	}
 
-		fmt.Print("no arguments given to search\n")
-		return
+	// folder was the old name for searching the arguments, which can now be files too
+	readsStdin := false
+	switch typeFlag {
+	case "paths", "folder":
+		if len(flag.Args()) == 0 {
+			fmt.Print("no arguments given to search\n")
+			os.Exit(exitErrors)
+		}
+		for _, arg := range flag.Args() {
+			readsStdin = readsStdin || arg == stdinArg
+		}
+	case "files":
+		if len(flag.Args()) > 0 {
+			fmt.Print("-type=files reads the files to search from stdin, no arguments can be given\n")
+			os.Exit(exitErrors)
+		}
+		readsStdin = true
+	default:
+		fmt.Print(fmt.Sprintf("unknown type \"%s\", use paths or files\n", typeFlag))
+		os.Exit(exitErrors)
 	}
 
-	// sequential operation ----------------------------------------------------
-	var verboseOutputSeq string
-	var fullCountSeq int64
-	var charCountSeq int64
-	var fileCountSeq int64
-	var fileCountMapSeq string
+	// stdin can only be read once, so it can not be searched twice to compare the methods
+	if readsStdin && methodFLag == "bench" {
+		fmt.Print("stdin can not be searched with -method=bench\n")
+		os.Exit(exitErrors)
+	}
+
+	// -C gives the amount of context on either side unless -A or -B say otherwise
+	afterContext = int64(contextFlag)
+	beforeContext = int64(contextFlag)
+	if afterContextFlag >= 0 {
+		afterContext = int64(afterContextFlag)
+	}
+	if beforeContextFlag >= 0 {
+		beforeContext = int64(beforeContextFlag)
+	}
+
+	if filesWithMatchesFlag && filesWithoutMatchesFlag {
+		fmt.Print("-l and -L can not be used together\n")
+		os.Exit(exitErrors)
+	}
+	if sortFlag != "none" && sortFlag != "path" && sortFlag != "count" {
+		fmt.Print(fmt.Sprintf("unknown sort \"%s\", use path, count or none\n", sortFlag))
+		os.Exit(exitErrors)
+	}
+	if (quietFlag || filesWithMatchesFlag || filesWithoutMatchesFlag) && methodFLag == "bench" {
+		fmt.Print("-q, -l and -L can not be used with -method=bench\n")
+		os.Exit(exitErrors)
+	}
+
+	// a file only needs searching up to its first match to know if it has one
+	if quietFlag || filesWithMatchesFlag || filesWithoutMatchesFlag {
+		fileMatchLimit = 1
+	} else if maxCountFlag >= 0 {
+		fileMatchLimit = maxCountFlag
+	}
+
+	if binaryFlag != "skip" && binaryFlag != "text" && binaryFlag != "count-only" {
+		fmt.Print(fmt.Sprintf("unknown binary mode \"%s\", use skip, text or count-only\n", binaryFlag))
+		os.Exit(exitErrors)
+	}
+
+	if (followFlag || oneFileSystemFlag) && false == fileIdentitySupported {
+		fmt.Print("-follow and -one-file-system are not supported on this platform\n")
+		os.Exit(exitErrors)
+	}
+
+	loadGlobalIgnoreRules()
+
+	err := loadSearchPatterns()
+	if err == nil {
+		err = checkFilterGlobs()
+	}
+	if err != nil {
+		fmt.Print(err.Error() + "\n")
+		os.Exit(exitErrors)
+	}
+	if len(searchPatterns) == 0 {
+		fmt.Print("no search string given, use -str or -patterns-file\n")
+		os.Exit(exitErrors)
+	}
+
+	// compile the search strings once so every file shares the same matcher,
+	// case insensitive searches use expressions too so unicode case folding is handled
+	if regexFlag || ignoreCaseFlag {
+		for _, pattern := range searchPatterns {
+			expression := pattern
+			if false == regexFlag {
+				expression = regexp.QuoteMeta(pattern)
+			}
+			if ignoreCaseFlag {
+				expression = "(?i)" + expression
+			}
+
+			re, err := regexp.Compile(expression)
+			if err != nil {
+				fmt.Print(fmt.Sprintf("invalid regular expression \"%s\": %s\n", pattern, err.Error()))
+				os.Exit(exitErrors)
+			}
+			searchRegexes = append(searchRegexes, re)
+		}
+	} else {
+		searchAutomaton = newAhoCorasick(searchPatterns)
+	}
+
+	ctx, cancel := newSearchContext()
+	defer cancel()
+
+	var report searchReport
+	switch methodFLag {
+	case "seq":
+		report = runSearch(ctx, searchFoldersSeq)
+		printReport("Sequential operation", report)
+
+	case "para":
+		report = runSearch(ctx, searchFoldersPara)
+		printReport("Parallel operation", report)
+
+	case "bench":
+		report = runBenchmark(ctx)
+
+	default:
+		fmt.Print(fmt.Sprintf("unknown method \"%s\", use seq, para or bench\n", methodFLag))
+		os.Exit(exitErrors)
+	}
+
+	cancel()
+	os.Exit(exitCode(report))
+}
+
+// the exit status once a search is over, errors and stopping early take priority over whether anything
+// matched, other than with -q where finding a match is all that was asked. As with grep, -L succeeds
+// when it lists a file, which is one without a match
+func exitCode(report searchReport) int {
+	if quietFlag && report.fullCount > 0 {
+		return exitMatches
+	}
+	if len(report.errors) > 0 || report.cancelled != "" {
+		return exitErrors
+	}
+	if filesWithoutMatchesFlag {
+		if report.listedFiles == 0 {
+			return exitNoMatches
+		}
+		return exitMatches
+	}
+	if report.fullCount == 0 {
+		return exitNoMatches
+	}
+	return exitMatches
+}
 
+// collect the search strings from the -str flags and the -patterns-file, one per line, skipping blanks and repeats
+func loadSearchPatterns() error {
+	patterns := append([]string{}, searchStrFlags...)
+
+	if patternsFileFlag != "" {
+		fileData, err := ioutil.ReadFile(patternsFileFlag)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(fileData), "\n") {
+			patterns = append(patterns, strings.TrimRight(line, "\r"))
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		if pattern == "" || seen[pattern] {
+			continue
+		}
+		seen[pattern] = true
+		searchPatterns = append(searchPatterns, pattern)
+	}
+
+	return nil
+}
+
+// the results and timing of a single run of one of the search functions
+type searchReport struct {
+	fullCount     int64
+	patternCounts []int64
+	charCount     int64
+	fileCount     int64
+	binaryFiles   int64 // files skipped or only counted by the -binary mode
+	readFiles     int64 // files that were read in blocks
+	mappedFiles   int64 // files that were memory mapped rather than read
+	matchedFiles  int64 // files with at least one occurrence
+	listedFiles   int64 // files that -l or -L list
+	errors        []SearchError
+	cancelled     string // why the search stopped before it finished, the results are only partial if set
+	elasped       time.Duration
+
+	stopEarly context.CancelFunc // ends the search once enough has been found, see searchComplete
+}
+
+// add the results of a searched file into the totals
+func (r *searchReport) addResult(result FileResult) {
+	r.fullCount += result.Occurrences
+	r.charCount += result.CharCount
+	for patternIdx, count := range result.PatternCounts {
+		r.patternCounts[patternIdx] += count
+	}
+	if result.Binary {
+		r.binaryFiles++
+	}
+	if result.ReadMethod == "read" {
+		r.readFiles++
+	}
+	if result.ReadMethod == "mmap" {
+		r.mappedFiles++
+	}
+	if result.Occurrences > 0 {
+		r.matchedFiles++
+	}
+	if isListed(result) {
+		r.listedFiles++
+	}
+}
+
+func (r searchReport) charsPerSecond() float64 {
+	return float64(r.charCount) / r.elasped.Seconds()
+}
+
+func (r searchReport) filesPerSecond() float64 {
+	return float64(r.fileCount) / r.elasped.Seconds()
+}
+
+// run one of the search functions over the arguments to the program and time it, the search stops
+// early if the context is cancelled or it stops itself as nothing more needs to be found
+func runSearch(ctx context.Context, search func(ctx context.Context, report *searchReport)) searchReport {
+	searchCtx, stopEarly := context.WithCancel(ctx)
+	defer stopEarly()
+	report := searchReport{patternCounts: make([]int64, len(searchPatterns)), stopEarly: stopEarly}
+
+	startTime := time.Now()
+	search(searchCtx, &report)
+	report.elasped = time.Since(startTime)
+	report.cancelled = cancelReason(ctx)
+
+	return report
+}
+
+// check if the search has found all that it needs to with this many occurrences so far, with -q
+// the first match is enough to say there is one
+func searchComplete(occurrences int64) bool {
+	return quietFlag && occurrences > 0
+}
+
+// run both the sequential and parallel searches and compare their performance, both search the
+// same files so the sequential report is returned to decide the exit status
+func runBenchmark(ctx context.Context) searchReport {
+
+	// sequential operation ----------------------------------------------------
 	fmt.Print("\nBegin sequential\n")
-	startTimeSeq := time.Now()
-	searchFoldersSeq(&verboseOutputSeq, &fileCountMapSeq, &fileCountSeq, &charCountSeq, &fullCountSeq)
-	elaspedSeq := time.Since(startTimeSeq)
+	seq := runSearch(ctx, searchFoldersSeq)
 	fmt.Print("End sequential\n")
-	elaspedInSecondsSeq := elaspedSeq.Seconds()
-	charsPerSecondSeq := float64(charCountSeq) / elaspedInSecondsSeq
-	filesPerSecondSeq := float64(fileCountSeq) / elaspedInSecondsSeq
-
 	//--------------------------------------------------------------------------
 
 	// parallel operation ------------------------------------------------------
-	var verboseOutputPara string
-	var fullCountPara int64
-	var charCountPara int64
-	var fileCountPara int64
-	var fileCountMapPara string
-
 	fmt.Print("Begin parallel\n")
-	startTimePara := time.Now()
-	searchFoldersPara(&verboseOutputPara, &fileCountMapPara, &fileCountPara, &charCountPara, &fullCountPara)
-	elaspedPara := time.Since(startTimePara)
+	para := runSearch(ctx, searchFoldersPara)
 	fmt.Print("End parallel\n")
-	elaspedInSecondsPara := elaspedPara.Seconds()
-	charsPerSecondPara := float64(charCountPara) / elaspedInSecondsPara
-	filesPerSecondPara := float64(fileCountPara) / elaspedInSecondsPara
 	//--------------------------------------------------------------------------
 
 	// operation report --------------------------------------------------------
 	fmt.Print("\nSummary\n")
 	fmt.Print("-----------------------------------------------\n")
 	fmt.Print(fmt.Sprintf("CPUs : %d", cpuCount))
-	fmt.Print("\nSequential operation\n")
-	fmt.Print("---------------------\n")
-	fmt.Print(fmt.Sprintf("Search string: \"%s\" Total occurrences: %d \n", searchStrFlag, fullCountSeq))
-	fmt.Print(fmt.Sprintf("Characters scanned: %d \n", charCountSeq))
-	fmt.Print(fmt.Sprintf("Files scanned: %d \n", fileCountSeq))
-	fmt.Print(fmt.Sprintf("Time elasped: %s \n", elaspedSeq))
-	fmt.Print(fmt.Sprintf("Characters per second: %.5f \n", charsPerSecondSeq))
-	fmt.Print(fmt.Sprintf("Files per second: %.5f \n", filesPerSecondSeq))
-	fmt.Print("\nParallel operation\n")
-	fmt.Print("---------------------\n")
-	fmt.Print(fmt.Sprintf("Search string: \"%s\" Total occurrences: %d \n", searchStrFlag, fullCountPara))
-	fmt.Print(fmt.Sprintf("Characters scanned: %d \n", charCountPara))
-	fmt.Print(fmt.Sprintf("Files scanned: %d \n", fileCountPara))
-	fmt.Print(fmt.Sprintf("Time elasped: %s \n", elaspedPara))
-	fmt.Print(fmt.Sprintf("Characters per second: %.5f \n", charsPerSecondPara))
-	fmt.Print(fmt.Sprintf("Files per second: %.5f \n", filesPerSecondPara))
+	printTextReport("Sequential operation", seq)
+	printTextReport("Parallel operation", para)
 	fmt.Print("\n-----------------------------------------------\n")
 
+	elaspedInSecondsSeq := seq.elasped.Seconds()
+	charsPerSecondSeq := seq.charsPerSecond()
+	filesPerSecondSeq := seq.filesPerSecond()
+	elaspedInSecondsPara := para.elasped.Seconds()
+	charsPerSecondPara := para.charsPerSecond()
+	filesPerSecondPara := para.filesPerSecond()
+
 	// speed calculations
 	paraFaster := false
 	if elaspedInSecondsPara < elaspedInSecondsSeq {
@@ -140,290 +510,886 @@ func main() {
 	fmt.Print(fileThroughputString)
 	fmt.Print(charThroughputString)
 	fmt.Print(executionString)
+
+	return seq
 }
 
-// search the folders provided in the arguments to the program - search is done in parallel
-func searchFoldersPara(verboseOutput, fileCountMap *string, fileCount, charCount, fullCount *int64) {
+// search the folders provided in the arguments to the program - search is done in parallel. Once the context
+// is cancelled no more jobs are made and the workers skip the ones left, and as the aggregator only stops
+// when the results channel is closed it still finishes with what was found so far
+func searchFoldersPara(ctx context.Context, report *searchReport) {
 
-	fileList := []string{}
+	var workersWg sync.WaitGroup
+	var aggregatorWg sync.WaitGroup
+	openedFiles := make(semaphore, cpuCount)
+	fileJobsChan := make(chan fileJob, cpuCount)
+	resultsChan := make(chan jobResult, cpuCount)
 
-	// build up the list of files that we are going to search
-	for _, directoryArg := range flag.Args() {
-		// walk through each directory and get the names of files
-		err := filepath.Walk(directoryArg, func(path string, fileInfo os.FileInfo, err error) error {
-			// check that we are only listing directories and .txt files in our list
-			if false == fileInfo.IsDir() {
-				fileList = append(fileList, path)
-			}
-			return nil
-		})
-		check(err)
+	// kick off a fixed pool of workers who wait to be given jobs
+	workerCount := workerCountFlag
+	if workerCount <= 0 {
+		workerCount = cpuCount
+	}
+	for i := 0; i < workerCount; i++ {
+		workersWg.Add(1)
+		go worker(ctx, searchAutomaton, fileJobsChan, resultsChan, &workersWg, i, openedFiles)
 	}
 
-	*fileCount = int64(len(fileList))
-
-	var wg sync.WaitGroup
-	fileListLen := int64(len(fileList))
-	openedFiles := make(semaphore, cpuCount)
-	fileJobsChan := make(chan string, cpuCount)
-	verboseOutputChan := make(chan string, cpuCount)
-	fileCountMapChan := make(chan string, cpuCount)
-	occurrenceCountChan := make(chan int64, cpuCount)
-	charCountChan := make(chan int64, cpuCount)
-
-	// kick off all the workers who wait to be given jobs
-	for i := range fileList {
-		wg.Add(1)
-		go worker(searchStrFlag, fileJobsChan, verboseOutputChan, fileCountMapChan, charCountChan, occurrenceCountChan, &wg, i, openedFiles)
+	// to show the results in walk order the jobs can only get so far ahead of the results shown
+	var jobWindow semaphore
+	if sortFlag == "path" {
+		jobWindow = make(semaphore, reorderWindowSize)
 	}
 
-	// create all the job
-	wg.Add(1)
-	go jobMaker(fileJobsChan, fileList, &wg)
+	// create the jobs while the folders are still being walked
+	workersWg.Add(1)
+	go jobMaker(ctx, fileJobsChan, jobWindow, resultsChan, &report.fileCount, &workersWg)
 
 	// collect the results
-	wg.Add(4)
-	go occurrenceCountCollector(fullCount, occurrenceCountChan, fileListLen, &wg)
-	go fileCountMapCollector(fileCountMap, fileCountMapChan, fileListLen, &wg)
-	go verboseOutputCollector(verboseOutput, verboseOutputChan, fileListLen, &wg)
-	go charCountCollector(charCount, charCountChan, fileListLen, &wg)
+	aggregatorWg.Add(1)
+	go resultAggregator(report, newResultPrinter(sortFlag, jobWindow), resultsChan, &aggregatorWg)
 
-	wg.Wait()
-
-	close(verboseOutputChan)
-	close(fileCountMapChan)
-	close(occurrenceCountChan)
-	close(charCountChan)
+	// once every worker and the walk are done no more results can arrive, so let the aggregator finish
+	workersWg.Wait()
+	close(resultsChan)
+	aggregatorWg.Wait()
 }
 
 // search the folders provided in the arguments to the program - search is done sequentially
-func searchFoldersSeq(fullResult, fileCountMap *string, fileCount, charCount, fullCount *int64) {
-
-	fileList := []string{}
-
-	var resultsBuffer bytes.Buffer
-	var totalOccurrences int64
-	var totalChars int64
-	var fileReportBuffer bytes.Buffer
-
-	// build up the list of files that we are going to search
-	for _, directoryArg := range flag.Args() {
-		// walk through each directory and get the names of files
-		err := filepath.Walk(directoryArg, func(path string, fileInfo os.FileInfo, err error) error {
-			// check that we are only listing directories and .txt files in our list
-			if false == fileInfo.IsDir() {
-				fileList = append(fileList, path)
-			}
-			return nil
-		})
-		check(err)
-	}
-
-	// go through the file list and search each file
-	for _, originFileName := range fileList {
-		// read the file into a byte buffer
-		fileData, err := ioutil.ReadFile(originFileName)
-		if err == nil {
-			// if name was qualified chop it down to the base / showten if need be
-			fileName := filepath.Base(originFileName)
-			if len(fileName) > 25 {
-				fileName = fileName[:25] + "..."
-			}
+func searchFoldersSeq(ctx context.Context, report *searchReport) {
 
-			// search the file for the target string
-			if true == progressFlag {
-				fmt.Print(fmt.Sprintf("Searching file: %s \n", fileName))
-			}
-			output, numFound, numChars := searchBytes(searchStrFlag, []byte(fileData), fileName)
+	// the walk is already in path order
+	sortBy := sortFlag
+	if sortBy == "path" {
+		sortBy = "none"
+	}
+	printer := newResultPrinter(sortBy, nil)
 
-			// update variables storing information
-			totalOccurrences += numFound
-			totalChars += numChars
-			resultsBuffer.WriteString(output)
-			fileReportBuffer.WriteString(fmt.Sprintf("%s : %d occurrences\n", fileName, numFound))
-		} else {
-			check(err)
-		}
+	walkSearchPaths(ctx, true, func(path string) {
+		report.fileCount++
+		searchFileSeq(ctx, path, report, printer)
+	}, func(path string, err error) {
+		report.errors = append(report.errors, newSearchError(path, err))
+	})
+
+	printer.flush()
+}
+
+// search a single file for the sequential method and add its results to the totals,
+// a file the search was cancelled part way through is left out
+func searchFileSeq(ctx context.Context, originFileName string, report *searchReport, printer *resultPrinter) {
+	if ctx.Err() != nil {
+		return
 	}
 
-	*fileCount = int64(len(fileList))
-	*fullResult = resultsBuffer.String()
-	*fileCountMap = fileReportBuffer.String()
-	*fullCount = totalOccurrences
-	*charCount = totalChars
+	// search the file for the target string
+	printProgress(originFileName)
+	result, err := searchFile(ctx, searchAutomaton, originFileName, 1)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		report.errors = append(report.errors, newSearchError(originFileName, err))
+		return
+	}
+
+	// update variables storing information
+	report.addResult(result)
+	if searchComplete(report.fullCount) {
+		report.stopEarly()
+	}
+
+	// show the results for this file as soon as it has been searched, unless they are sorted
+	printer.add(jobResult{result: result, searched: true})
 }
 
-// routines that "makes" jobs (filenames) and puts them in a channel for workes to receive
-func jobMaker(fileJobsChan chan<- string, fileList []string, wg *sync.WaitGroup) {
+// routines that "makes" jobs (filenames) as the folders are walked and puts them in a channel for workes to receive,
+// the channel is closed once the walk is over or cancelled so the workers know to stop, anything that can not be
+// walked goes to resultsChan. With -sort=path the folders are walked one at a time so the jobs are made in walk order,
+// and a place in jobWindow is taken for each job.
+func jobMaker(ctx context.Context, fileJobsChan chan<- fileJob, jobWindow semaphore, resultsChan chan<- jobResult, fileCount *int64, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer close(fileJobsChan)
+
+	var foundFiles int64
+	walkSearchPaths(ctx, sortFlag == "path", func(path string) {
+		sendJob(ctx, fileJobsChan, jobWindow, path, &foundFiles)
+	}, func(path string, err error) {
+		resultsChan <- walkErrorResult(path, err)
+	})
+
+	*fileCount = atomic.LoadInt64(&foundFiles)
+}
 
-	for _, fileName := range fileList {
-		fileJobsChan <- fileName
+// count a file and hand it out as a job numbered by the count before it, unless the search is cancelled while
+// waiting for a place in the jobWindow, if there is one, or for a worker
+func sendJob(ctx context.Context, fileJobsChan chan<- fileJob, jobWindow semaphore, path string, foundFiles *int64) {
+	if jobWindow != nil {
+		select {
+		case jobWindow <- empty{}:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	seq := atomic.AddInt64(foundFiles, 1) - 1
+	select {
+	case fileJobsChan <- fileJob{path, seq}:
+	case <-ctx.Done():
 	}
 }
 
-// routine that performs the actual searching task
-func worker(targetStr string, fileJob <-chan string, resultsVerboseChan, resultsFileCountMapChan chan<- string,
-	charCountChan, totalCountChan chan<- int64, wg *sync.WaitGroup, id int, openedFilesSem semaphore) {
+// routine that performs the actual searching task, takes jobs until the job channel is closed,
+// once the context is cancelled the jobs left are taken without being searched
+func worker(ctx context.Context, matcher *ahoCorasick, fileJobs <-chan fileJob, resultsChan chan<- jobResult, wg *sync.WaitGroup, id int, openedFilesSem semaphore) {
 
 	defer wg.Done()
 
-	originFileName := <-fileJob
+	for job := range fileJobs {
+		if ctx.Err() != nil {
+			resultsChan <- jobResult{seq: job.seq}
+			continue
+		}
+		resultsChan <- searchFileJob(ctx, matcher, job, openedFilesSem)
+	}
+}
+
+// search a single file for a worker and make the record of the job, a file the search was cancelled
+// part way through is left out
+func searchFileJob(ctx context.Context, matcher *ahoCorasick, job fileJob, openedFilesSem semaphore) jobResult {
 
 	// acquire resource for opening files
 	sem := empty{}
 	openedFilesSem <- sem
 
-	// open and read from file
-	fileData, err := ioutil.ReadFile(originFileName)
+	// search the given file for the target string
+	printProgress(job.path)
+	result, err := searchFile(ctx, matcher, job.path, cpuCount)
 
-	if err == nil {
-		// if name was qualified chop it down to the base / showten if need be
-		fileName := filepath.Base(originFileName)
-		if len(fileName) > 25 {
-			fileName = fileName[:25] + "..."
+	// release resource for opening files
+	<-openedFilesSem
+
+	if ctx.Err() != nil {
+		// the results would only be part of the file
+		return jobResult{seq: job.seq}
+	}
+	if err != nil {
+		searchErr := newSearchError(job.path, err)
+		return jobResult{seq: job.seq, err: &searchErr}
+	}
+	return jobResult{seq: job.seq, result: result, searched: true}
+}
+
+// routine that adds the record of every job, and the errors of the walk, from resultsChan into the report and
+// shows the file results with the printer, calling stopEarly to cancel the work left once enough has been found.
+// It stops once the channel is closed, so it never waits on a job that ended without results.
+func resultAggregator(report *searchReport, printer *resultPrinter, resultsChan <-chan jobResult, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for record := range resultsChan {
+		if record.err != nil {
+			report.errors = append(report.errors, *record.err)
+		}
+		if record.searched {
+			report.addResult(record.result)
+			if searchComplete(report.fullCount) {
+				report.stopEarly()
+			}
 		}
+		if record.seq >= 0 {
+			printer.add(record)
+		}
+	}
+	printer.flush()
 
-		// search the given file for the target string then put results into channels
-		if true == progressFlag {
-			fmt.Print(fmt.Sprintf("Searching file: %s \n", fileName))
+	// the errors arrive in no particular order
+	sort.Slice(report.errors, func(i, j int) bool {
+		return report.errors[i].Path < report.errors[j].Path
+	})
+}
+
+// setup the flag arguments that the program uses
+func initFlags() {
+
+	flag.StringVar(&typeFlag, "type", "paths", `either paths to search the files and folders given as arguments, or files to read a newline or NUL separated list of files to search from stdin`)
+	flag.Var(&searchStrFlags, "str", `the string to search for, can be given more than once`)
+	flag.StringVar(&patternsFileFlag, "patterns-file", "", `file of strings to search for, one per line`)
+	flag.BoolVar(&verboseFlag, "verbose", false, `if flase only shows the number of occurrences, if true shows locations too`)
+	flag.StringVar(&methodFLag, "method", "seq", `search using the sequential (seq) or parallel (para) method, or compare both (bench)`)
+	flag.BoolVar(&progressFlag, "progress", false, `show the file currently being searched `)
+	flag.BoolVar(&fileMapFlag, "fileMap", false, `show how many occurences each file had`)
+	flag.IntVar(&cpuCountFlag, "cpus", -1, "number of CPU's to use")
+	flag.IntVar(&workerCountFlag, "workers", 0, "number of worker routines used by the parallel method, 0 uses one per CPU")
+	flag.BoolVar(&regexFlag, "regex", false, `treat the search string as a regular expression`)
+	flag.BoolVar(&ignoreCaseFlag, "i", false, `ignore case when matching, unicode aware`)
+	flag.BoolVar(&wordFlag, "w", false, `only count matches that form a whole word`)
+	flag.Var(&includeFlags, "include", `only search files matching this glob, can be given more than once`)
+	flag.Var(&excludeFlags, "exclude", `skip files matching this glob, can be given more than once`)
+	flag.Var(&excludeDirFlags, "exclude-dir", `skip folders matching this glob, can be given more than once`)
+	flag.Var(&extFlags, "ext", `only search files with these comma separated extensions, can be given more than once`)
+	flag.BoolVar(&followFlag, "follow", false, `follow symbolic links found in folders, links given as arguments are always followed`)
+	flag.BoolVar(&oneFileSystemFlag, "one-file-system", false, `do not walk into folders on a different device to the folder being searched`)
+	flag.BoolVar(&noIgnoreFlag, "no-ignore", false, `search files that .gitignore, .ignore and the global git excludes would skip`)
+	flag.DurationVar(&timeoutFlag, "timeout", 0, `stop searching after this long, such as 30s, and report what was found so far, 0 never stops`)
+	flag.Int64Var(&mmapThresholdFlag, "mmap-threshold", 64*1024*1024, `size in bytes from which files are memory mapped rather than read, -1 never maps`)
+	flag.Int64Var(&segmentSizeFlag, "segment-size", 16*1024*1024, `size in bytes of the segments the parallel method splits memory mapped files into to search them on every CPU, 0 never splits`)
+	flag.StringVar(&binaryFlag, "binary", "skip", `how to handle binary files, either skip, text or count-only`)
+	flag.Int64Var(&maxCountFlag, "max-count", -1, `stop searching a file after this many occurrences, -1 for no limit`)
+	flag.BoolVar(&filesWithMatchesFlag, "l", false, `only list the files that have a match, each file stops being searched at its first match`)
+	flag.BoolVar(&filesWithoutMatchesFlag, "L", false, `only list the files that have no match`)
+	flag.BoolVar(&quietFlag, "q", false, `print nothing and stop at the first match, the exit status tells if there was one`)
+	flag.IntVar(&afterContextFlag, "A", -1, `number of lines of context to show after each match with -verbose`)
+	flag.IntVar(&beforeContextFlag, "B", -1, `number of lines of context to show before each match with -verbose`)
+	flag.IntVar(&contextFlag, "C", 0, `number of lines of context to show either side of each match with -verbose`)
+	flag.StringVar(&sortFlag, "sort", "none", `order the results are shown in: path for the order the files are walked in, count for the most occurrences first, or none to show them as they are found`)
+	flag.StringVar(&formatFlag, "format", "text", `output format, either text, json or jsonl`)
+
+	flag.Parse()
+}
+
+// open the file at "path" and search it, or standard input when the path is "-". Files at or above the
+// -mmap-threshold size are memory mapped and searched in place, others (or ones that fail to map) are read
+// a block at a time. Mapped files bigger than -segment-size are split up and searched by up to "routines"
+// routines at once, unless the search of each file stops after a number of matches. Files stop being
+// searched part way through once the context is cancelled.
+func searchFile(ctx context.Context, matcher *ahoCorasick, path string, routines int) (FileResult, error) {
+	if path == stdinArg {
+		result, err := searchBytes(ctx, matcher, contextReader{ctx, os.Stdin}, stdinPath)
+		result.ReadMethod = "read"
+		return result, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return FileResult{Path: path}, err
+	}
+	defer file.Close()
+
+	if mmapThresholdFlag >= 0 {
+		fileInfo, err := file.Stat()
+		if err == nil && fileInfo.Mode().IsRegular() && fileInfo.Size() > 0 && fileInfo.Size() >= mmapThresholdFlag {
+			data, err := mapFile(file, fileInfo.Size())
+			if err == nil {
+				defer unmapFile(data)
+				var result FileResult
+				if routines > 1 && segmentSizeFlag > 0 && fileInfo.Size() > segmentSizeFlag && fileMatchLimit < 0 {
+					result, err = searchMemorySplit(ctx, matcher, data, path, routines)
+				} else {
+					result, err = searchMemory(ctx, matcher, data, path)
+				}
+				result.ReadMethod = "mmap"
+				return result, err
+			}
+		}
+	}
+
+	result, err := searchBytes(ctx, matcher, file, path)
+	result.ReadMethod = "read"
+	return result, err
+}
+
+// search data that is already in memory, such as a memory mapped file, a stride of memoryStrideSize bytes
+// at a time so the search stops soon after the context is cancelled, returning the error of the context.
+// The automaton carries on from one stride to the next, expressions are run over strides of whole lines.
+func searchMemory(ctx context.Context, matcher *ahoCorasick, data []byte, path string) (FileResult, error) {
+	state := newSearchState(path)
+	if state.checkBinary(data) {
+		return skippedBinaryResult(path), nil
+	}
+
+	if searchRegexes != nil {
+		for _, stride := range splitSegments(data, memoryStrideSize) {
+			if err := ctx.Err(); err != nil {
+				return state.finish(), err
+			}
+			if state.limitReached() {
+				break
+			}
+			state.offset = int64(stride.start)
+			state.searchRegexLines(searchRegexes, data[stride.start:stride.end])
 		}
-		output, numFound, numChars := searchBytes(targetStr, fileData, fileName)
-		totalCountChan <- numFound
-		charCountChan <- numChars
-		resultsVerboseChan <- output
-		resultsFileCountMapChan <- fmt.Sprintf("%s : %d occurrences\n", fileName, numFound)
 	} else {
-		//check(err)
-		fmt.Print(err.Error() + "\n")
+		scan := automatonScan{lastMatchEnd: make([]int, len(matcher.patterns)), untilLimit: true, withText: true}
+		for from := 0; from < len(data) && false == state.limitReached(); from += memoryStrideSize {
+			if err := ctx.Err(); err != nil {
+				return state.finish(), err
+			}
+			to := from + memoryStrideSize
+			if to > len(data) {
+				to = len(data)
+			}
+			if state.runAutomaton(matcher, data, &scan, from, to, to) < to {
+				// stopped at the limit
+				break
+			}
+		}
+		scan.finishLine(state, data)
 	}
 
-	// release resource for opening files
-	<-openedFilesSem
+	state.collectContext(data, 1, state.result.Matches)
+	state.result.CharCount = int64(len(data))
+	return state.finish(), nil
 }
 
-// routine to collect the number of matches from occurrenceCountChan and put it into fullCount
-func occurrenceCountCollector(fullCount *int64, occurrenceCountChan <-chan int64, items int64, wg *sync.WaitGroup) {
-	defer wg.Done()
-	var sumOccurences int64
+// check for a NUL byte in the first block of the data, as git does. Text can start with the signature
+// of a binary format, such as "BM" for a bitmap, so the signature of a known binary format such as an
+// image or archive only counts if there are control characters in the block as well
+func isBinary(data []byte) bool {
+	if len(data) > binarySniffLen {
+		data = data[:binarySniffLen]
+	}
+	if bytes.IndexByte(data, 0) != -1 {
+		return true
+	}
+	if false == hasControlChars(data) {
+		return false
+	}
+	return false == strings.HasPrefix(http.DetectContentType(data), "text/")
+}
 
-	for i := int64(0); i < items; i++ {
-		sumOccurences += <-occurrenceCountChan
+// check for bytes that are never found in text, the whitespace control characters and
+// the escape that starts a terminal colour code are allowed
+func hasControlChars(data []byte) bool {
+	for _, b := range data {
+		if (b < 0x20 && false == strings.ContainsRune("\t\n\v\f\r\x1b", rune(b))) || b == 0x7f {
+			return true
+		}
 	}
+	return false
+}
 
-	*fullCount = sumOccurences
+// position and results carried from one block of lines to the next while a file is searched
+type searchState struct {
+	result    FileResult
+	lineNum   int64 // line number of the start of the next block
+	offset    int64 // offset in the file of the start of the next block
+	countOnly bool  // the file is binary so only the occurrences are kept
+	found     int64 // occurrences found so far, the search of the file stops at fileMatchLimit
+
+	// lines waiting to be used as context, the last lines seen that could still come before
+	// a match and the number of lines still to be shown after the last match
+	contextBefore []ContextLine
+	contextAfter  int64
 }
 
-// routine to collect the verbose output from the verboseOutputChan and put it into the string verboseOutput
-func verboseOutputCollector(verboseOutput *string, verboseOutputChan <-chan string, items int64, wg *sync.WaitGroup) {
-	defer wg.Done()
-	var verboseOutputBuffer bytes.Buffer
+func newSearchState(path string) *searchState {
+	return &searchState{
+		result:  FileResult{Path: path, PatternCounts: make([]int64, len(searchPatterns))},
+		lineNum: 1,
+	}
+}
+
+// check if enough occurrences have been found in the file to stop searching it
+func (state *searchState) limitReached() bool {
+	return fileMatchLimit >= 0 && state.found >= fileMatchLimit
+}
 
-	for i := int64(0); i < items; i++ {
-		verboseOutputBuffer.WriteString(<-verboseOutputChan)
+// check if the file is binary from the start of its data and handle it as the -binary flag asks,
+// returns true if the file should be skipped
+func (state *searchState) checkBinary(start []byte) bool {
+	if binaryFlag == "text" || false == isBinary(start) {
+		return false
 	}
+	state.countOnly = true
+	return binaryFlag == "skip"
+}
 
-	*verboseOutput = verboseOutputBuffer.String()
+// the result for a binary file that was not searched
+func skippedBinaryResult(path string) FileResult {
+	return FileResult{Path: path, PatternCounts: make([]int64, len(searchPatterns)), Binary: true}
 }
 
-// routine to collect the file names with thier occurrence counts from fileCountMapChan and put it into fileCountMap
-func fileCountMapCollector(fileCountMap *string, fileCountMapChan <-chan string, items int64, wg *sync.WaitGroup) {
-	defer wg.Done()
-	var fileCountMapBuffer bytes.Buffer
+// the buffers files are read into, shared between searches so they are only allocated once
+var readBufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, readBufferSize)
+		return &buffer
+	},
+}
+
+// search the for every search string known to "matcher" in the data read from "reader", which holds
+// the file at "path". The data is read in blocks into a pooled buffer. The automaton carries on from
+// where it got to in the block before, so only the few bytes a match could have started in, and the line
+// it is on if the text of lines is shown, are carried over to the front of the buffer for the next read.
+// Expressions are run a line at a time, so for them the unfinished line at the end of a block is carried over.
+func searchBytes(ctx context.Context, matcher *ahoCorasick, reader io.Reader, path string) (FileResult, error) {
+	state := newSearchState(path)
+
+	bufferPtr := readBufferPool.Get().(*[]byte)
+	defer readBufferPool.Put(bufferPtr)
+	buffer := *bufferPtr
+
+	filled := 0
+	checkedBinary := false
+	var stream *automatonStream
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return state.finish(), err
+		}
+
+		n, err := reader.Read(buffer[filled:])
+		filled += n
+		atEOF := err == io.EOF
+		if err != nil && false == atEOF {
+			return state.finish(), err
+		}
+
+		// decide if the file is binary once enough of it has been read
+		if false == checkedBinary && (filled >= binarySniffLen || atEOF) {
+			checkedBinary = true
+			if state.checkBinary(buffer[:filled]) {
+				return skippedBinaryResult(path), nil
+			}
+			if searchRegexes == nil {
+				stream = newAutomatonStream(matcher, lineTextShown() && false == state.countOnly)
+			}
+		}
+
+		if stream != nil {
+			consumed, done := stream.search(state, matcher, buffer[:filled], atEOF)
+			filled = copy(buffer, buffer[consumed:filled])
+			if done {
+				return state.finish(), nil
+			}
+		} else if checkedBinary {
+			// search up to the end of the last whole line, or everything once the file is over
+			blockEnd := filled
+			if false == atEOF {
+				blockEnd = lastLineEnd(buffer[:filled])
+			}
+			if blockEnd > 0 {
+				state.searchLines(matcher, buffer[:blockEnd])
+				filled = copy(buffer, buffer[blockEnd:filled])
+			}
+			if atEOF || state.limitReached() {
+				return state.finish(), nil
+			}
+		}
+
+		// what has to be carried over fills the whole buffer, make room for more
+		if filled == len(buffer) {
+			grown := make([]byte, 2*len(buffer))
+			copy(grown, buffer)
+			buffer = grown
+		}
+	}
+}
 
-	for i := int64(0); i < items; i++ {
-		fileCountMapBuffer.WriteString(<-fileCountMapChan)
+// check if the text of the lines that matches are on is shown, if not the search does not keep it
+func lineTextShown() bool {
+	if quietFlag || filesWithMatchesFlag || filesWithoutMatchesFlag {
+		return false
 	}
+	return verboseFlag || formatFlag != "text"
+}
 
-	*fileCountMap = fileCountMapBuffer.String()
+// find the end of the last whole line in the buffer, just after its line break, a '\r' right at
+// the end is left for the next block as the '\n' of a "\r\n" could still be on its way
+func lastLineEnd(buffer []byte) int {
+	lineBreak := bytes.LastIndexAny(buffer, "\r\n")
+	if lineBreak == len(buffer)-1 && buffer[lineBreak] == '\r' {
+		lineBreak = bytes.LastIndexAny(buffer[:lineBreak], "\r\n")
+	}
+	return lineBreak + 1
 }
 
-// routine to collect the number of characters from charCountChan and put it into charCount
-func charCountCollector(charCount *int64, charCountChan <-chan int64, items int64, wg *sync.WaitGroup) {
-	defer wg.Done()
-	var sumChars int64
+// the results of the search once every block has been searched
+func (state *searchState) finish() FileResult {
+	result := state.result
+	for _, count := range result.PatternCounts {
+		result.Occurrences += count
+	}
 
-	for i := int64(0); i < items; i++ {
-		sumChars += <-charCountChan
+	// for binary files the occurrences are kept but the matched "lines" would only be garbage
+	if state.countOnly {
+		result.Matches = nil
+		result.Context = nil
+		result.Binary = true
+		return result
 	}
 
-	*charCount = sumChars
+	// the automaton finds matches in the order they end and a file searched in segments has them in
+	// the order of the segments they start in, put them in the order they start in the file
+	sort.SliceStable(result.Matches, func(i, j int) bool {
+		if result.Matches[i].Offset != result.Matches[j].Offset {
+			return result.Matches[i].Offset < result.Matches[j].Offset
+		}
+		return result.Matches[i].PatternIdx < result.Matches[j].PatternIdx
+	})
+	return result
 }
 
-// setup the flag arguments that the program uses
-func initFlags() {
+// search a block of whole lines, the Aho-Corasick automaton finds every search string in a single
+// pass over the data while expressions are run over each line in turn
+func (state *searchState) searchLines(matcher *ahoCorasick, block []byte) {
+	firstLine := state.lineNum
+	firstMatch := len(state.result.Matches)
 
-	flag.StringVar(&typeFlag, "type", "folder", `specify if either file names or folders names will be provided to search`)
-	flag.StringVar(&searchStrFlag, "str", "null", `the string to search for`)
-	flag.BoolVar(&verboseFlag, "verbose", false, `if flase only shows the number of occurrences, if true shows locations too`)
-	flag.StringVar(&methodFLag, "method", "seq", `search in using either the sequential or parrallel method`)
-	flag.BoolVar(&progressFlag, "progress", false, `show the file currently being searched `)
-	flag.BoolVar(&fileMapFlag, "fileMap", false, `show how many occurences each file had`)
-	flag.IntVar(&cpuCountFlag, "cpus", -1, "number of CPU's to use")
+	if searchRegexes != nil {
+		state.searchRegexLines(searchRegexes, block)
+	} else {
+		state.searchAutomatonRange(matcher, block, 0, len(block), make([]int, len(matcher.patterns)))
+	}
 
-	flag.Parse()
+	state.collectContext(block, firstLine, state.result.Matches[firstMatch:])
+	state.offset += int64(len(block))
+	state.result.CharCount += int64(len(block))
 }
 
-// search the for the targetStr in the given byte array "data"
-func searchBytes(targetStr string, data []byte, fileName string) (string, int64, int64) {
+// run the automaton over data[from:to], reading on past "to" by up to the length of the longest search
+// string less one so a match that starts in the range but ends after it is still found. "lastMatchEnd"
+// holds where the last match of each pattern ended, a pattern only matches again once that match is over.
+func (state *searchState) searchAutomatonRange(matcher *ahoCorasick, data []byte, from, to int, lastMatchEnd []int) {
 
-	var outputBuffer bytes.Buffer
-	targetMatches := int64(len(targetStr))
-	var lastChar byte = ' '
-	var charCount int64
+	scanEnd := to + matcher.maxLen - 1
+	if scanEnd > len(data) {
+		scanEnd = len(data)
+	}
 
-	//outputBuffer.WriteString(fmt.Sprintf("File: %s \n", fileName))
+	scan := automatonScan{lastMatchEnd: lastMatchEnd, untilLimit: true, withText: true}
+	scan.startLine(bytes.LastIndexAny(data[:from], "\r\n") + 1)
+	state.runAutomaton(matcher, data, &scan, from, scanEnd, to)
+	scan.finishLine(state, data)
+}
 
-	// information about position in the current file
-	var lineNum, charNum, lastLineEnd int64
+// where the automaton got to in the data, so it can carry on from there with more of it
+type automatonScan struct {
+	state        int32 // state of the automaton
+	lineStart    int   // where the current line starts in the data
+	runes        int64 // runes in the current line before runesFrom, so the line can be dropped as it is read
+	runesFrom    int
+	lastMatchEnd []int // where the last match of each pattern ended
+	untilLimit   bool  // stop at the first match over fileMatchLimit, rather than carry on over the lines without counting
+	withText     bool  // give the matches the text of their line
+	textPending  bool  // the matches from textFrom on are on the current line and are waiting for its text
+	textFrom     int
+}
 
-	if targetMatches > 0 {
-		lineNum = 1
-	} else {
-		return "", 0, 0
+// a new line starts at data[lineStart]
+func (scan *automatonScan) startLine(lineStart int) {
+	scan.state = 0
+	scan.lineStart = lineStart
+	scan.runes = 0
+	scan.runesFrom = lineStart
+}
+
+// the current line ends at data[lineEnd], give the matches on it its text
+func (scan *automatonScan) endLine(state *searchState, data []byte, lineEnd int) {
+	if false == scan.textPending {
+		return
 	}
+	lineText := string(data[scan.lineStart:lineEnd])
+	for i := scan.textFrom; i < len(state.result.Matches); i++ {
+		state.result.Matches[i].LineText = lineText
+	}
+	scan.textPending = false
+}
 
-	// infomation about the search process
-	var occurrencesFound, matchedChars int64
+// end the current line where the data ends, or at its line break if that is in the data
+func (scan *automatonScan) finishLine(state *searchState, data []byte) {
+	if false == scan.textPending {
+		return
+	}
+	lineEnd, _ := lineBounds(data, scan.lineStart)
+	scan.endLine(state, data, lineEnd)
+}
+
+// run the automaton over data[from:scanEnd] carrying on from where "scan" got to, only matches that start
+// before "startsBefore" are counted and the run stops at a line break at or past it as no match can run over
+// one. Returns where the run got to.
+func (state *searchState) runAutomaton(matcher *ahoCorasick, data []byte, scan *automatonScan, from, scanEnd, startsBefore int) int {
 
-	for byteIdx, byteVal := range data {
+	for byteIdx := from; byteIdx < scanEnd; byteIdx++ {
+		byteVal := data[byteIdx]
 
 		switch byteVal {
 
-		case '\n', '\r':
-			lineNum++
-			lastLineEnd = int64(byteIdx)
-			matchedChars = 0
-			charNum = 0
+		case '\r':
+			if byteIdx >= startsBefore {
+				return byteIdx
+			}
+			state.lineNum++
+			scan.endLine(state, data, byteIdx)
+			scan.startLine(byteIdx + 1)
+
+		case '\n':
+			if byteIdx >= startsBefore {
+				return byteIdx
+			}
+			// a '\n' straight after a '\r' ends the same line
+			if byteIdx == 0 || data[byteIdx-1] != '\r' {
+				state.lineNum++
+				scan.endLine(state, data, byteIdx)
+			}
+			scan.startLine(byteIdx + 1)
 
 		default:
-			if matchedChars == 0 {
-				if targetStr[matchedChars] == byteVal && lastChar == ' ' {
-					matchedChars++
+			scan.state = matcher.step(scan.state, byteVal)
+
+			// a match was found for each pattern ending in this state
+			for _, patternIdx := range matcher.outputs[scan.state] {
+				matchStart := byteIdx - (len(matcher.patterns[patternIdx]) - 1)
+				if matchStart < scan.lastMatchEnd[patternIdx] || matchStart >= startsBefore {
+					continue
+				}
+				if wordFlag && false == isWholeWord(data, matchStart, byteIdx+1) {
+					continue
+				}
+
+				if state.limitReached() {
+					if scan.untilLimit {
+						return byteIdx
+					}
+					continue
 				}
-			} else if targetStr[matchedChars] == byteVal {
-				// another matching byte was found
-				matchedChars++
-			} else {
-				// the bytes did not match
-				matchedChars = 0
+				scan.lastMatchEnd[patternIdx] = byteIdx + 1
+				state.result.PatternCounts[patternIdx]++
+				state.found++
+				if state.countOnly {
+					continue
+				}
+
+				if scan.withText && false == scan.textPending {
+					scan.textPending = true
+					scan.textFrom = len(state.result.Matches)
+				}
+				state.result.Matches = append(state.result.Matches, Match{
+					Path:       state.result.Path,
+					Line:       state.lineNum,
+					Column:     int64(matchStart - scan.lineStart + 1),
+					RuneColumn: scan.runes + int64(utf8.RuneCount(data[scan.runesFrom:matchStart])+1),
+					Pattern:    matcher.patterns[patternIdx],
+					PatternIdx: patternIdx,
+					Offset:     state.offset + int64(matchStart),
+				})
 			}
 		}
+	}
+	return scanEnd
+}
 
-		// a match was found
-		if targetMatches == matchedChars {
-			matchedChars = 0
-			occurrencesFound++
-			pos := charNum - (targetMatches - 1)
-			line := string(data[lastLineEnd+1 : lastLineEnd+charNum+1])
-			outputBuffer.WriteString(fmt.Sprintf("Match in :%s line: %d, pos: %d, %s \n", fileName, lineNum, pos, line))
+// the search of a file read a block at a time by the automaton, each block carries on from the position
+// reached in the one before. The data kept from one block to the next is only what the matches still to
+// be found could need: the bytes before the position a match ending after it could start in, or with the
+// rune before it for -w, and the current line when the text of lines is shown.
+type automatonStream struct {
+	scan         automatonScan
+	scanned      int   // how far into the data has been searched
+	keep         int   // bytes before the scanned position that are kept
+	contextFrom  int   // start of the first line not yet looked at for context lines
+	contextLine  int64 // line number of contextFrom
+	contextMatch int   // first match that could be on a line from contextFrom on
+}
+
+func newAutomatonStream(matcher *ahoCorasick, withText bool) *automatonStream {
+	return &automatonStream{
+		scan:        automatonScan{lastMatchEnd: make([]int, len(matcher.patterns)), withText: withText},
+		keep:        matcher.maxLen - 1 + utf8.UTFMax,
+		contextLine: 1,
+	}
+}
+
+// search the data read so far, which is the whole rest of the file if "atEOF" is set. Returns how many
+// bytes at the front of the data are no longer needed, and if the search of the file is done.
+func (stream *automatonStream) search(state *searchState, matcher *ahoCorasick, data []byte, atEOF bool) (int, bool) {
+	scan := &stream.scan
+
+	// unless the file is over leave the last few bytes, so there is a rune after every match for -w
+	// to look at and the '\n' of a "\r\n" is never read on its own
+	scanEnd := len(data)
+	if false == atEOF {
+		scanEnd -= utf8.UTFMax
+		if scanEnd > 0 && data[scanEnd-1] == '\r' {
+			scanEnd--
 		}
+	}
+	if scanEnd > stream.scanned {
+		state.runAutomaton(matcher, data, scan, stream.scanned, scanEnd, scanEnd)
+		state.result.CharCount += int64(scanEnd - stream.scanned)
+		stream.scanned = scanEnd
+	}
+
+	// the lines before the current one are over, or every line once the file is
+	contextTo := scan.lineStart
+	if atEOF {
+		scan.finishLine(state, data)
+		contextTo = len(data)
+	}
+	if scan.withText {
+		for stream.contextMatch < len(state.result.Matches) && state.result.Matches[stream.contextMatch].Line < stream.contextLine {
+			stream.contextMatch++
+		}
+		state.collectContext(data[stream.contextFrom:contextTo], stream.contextLine, state.result.Matches[stream.contextMatch:])
+		stream.contextFrom = contextTo
+		stream.contextLine = state.lineNum
+	}
 
-		lastChar = byteVal
-		charNum++
-		charCount++
+	// past the limit the search only goes on for the rest of the line of the last match and the context after it
+	if atEOF || (state.limitReached() && false == scan.textPending && state.contextAfter == 0) {
+		return 0, true
 	}
 
-	//outputBuffer.WriteString(fmt.Sprintf("Total occurrences: %d \n", occurrencesFound))
-	return outputBuffer.String(), occurrencesFound, charCount
+	// drop what is no longer needed, starting what is kept at the start of a rune so the runes
+	// on the line so far can be counted up to there
+	consumed := stream.scanned - stream.keep
+	if scan.withText && scan.lineStart < consumed {
+		consumed = scan.lineStart
+	}
+	for i := 1; i < utf8.UTFMax && consumed > 0 && false == utf8.RuneStart(data[consumed]); i++ {
+		consumed--
+	}
+	if consumed <= 0 {
+		return 0, false
+	}
+	if scan.runesFrom < consumed {
+		scan.runes += int64(utf8.RuneCount(data[scan.runesFrom:consumed]))
+		scan.runesFrom = consumed
+	}
+
+	scan.lineStart -= consumed
+	scan.runesFrom -= consumed
+	for patternIdx := range scan.lastMatchEnd {
+		scan.lastMatchEnd[patternIdx] -= consumed
+	}
+	stream.scanned -= consumed
+	stream.contextFrom -= consumed
+	state.offset += int64(consumed)
+	return consumed, false
+}
+
+// where an expression matched on a line
+type regexMatch struct {
+	patternIdx int
+	start      int
+}
+
+// run each of the compiled expressions over every line in the block
+func (state *searchState) searchRegexLines(expressions []*regexp.Regexp, block []byte) {
+
+	lineMatches := []regexMatch{}
+
+	for lineStart := 0; lineStart < len(block) && false == state.limitReached(); state.lineNum++ {
+		lineEnd, nextLineStart := lineBounds(block, lineStart)
+		lineData := block[lineStart:lineEnd]
+		lineMatches = lineMatches[:0]
+
+		for patternIdx, re := range expressions {
+			for _, loc := range re.FindAllIndex(lineData, -1) {
+				// skip empty matches, they carry no location worth reporting
+				if loc[0] == loc[1] {
+					continue
+				}
+				if wordFlag && false == isWholeWord(lineData, loc[0], loc[1]) {
+					continue
+				}
+				lineMatches = append(lineMatches, regexMatch{patternIdx, loc[0]})
+			}
+		}
+
+		// keep the matches of the different expressions in the order they appear on the line
+		sort.SliceStable(lineMatches, func(i, j int) bool {
+			return lineMatches[i].start < lineMatches[j].start
+		})
+
+		lineText := ""
+		for _, lineMatch := range lineMatches {
+			if state.limitReached() {
+				break
+			}
+			state.result.PatternCounts[lineMatch.patternIdx]++
+			state.found++
+			if state.countOnly {
+				continue
+			}
+
+			if lineText == "" {
+				lineText = string(lineData)
+			}
+			state.result.Matches = append(state.result.Matches, Match{
+				Path:       state.result.Path,
+				Line:       state.lineNum,
+				Column:     int64(lineMatch.start + 1),
+				RuneColumn: int64(utf8.RuneCount(lineData[:lineMatch.start]) + 1),
+				Pattern:    searchPatterns[lineMatch.patternIdx],
+				PatternIdx: lineMatch.patternIdx,
+				Offset:     state.offset + int64(lineStart+lineMatch.start),
+				LineText:   lineText,
+			})
+		}
+
+		lineStart = nextLineStart
+	}
+}
+
+// collect the lines of the block within the context distance of a match that are not match lines
+// themselves, "matches" are the matches found in the block which starts on line "firstLine"
+func (state *searchState) collectContext(block []byte, firstLine int64, matches []Match) {
+	if (afterContext == 0 && beforeContext == 0) || false == verboseFlag || state.countOnly {
+		return
+	}
+
+	nextMatch := 0
+	lineNum := firstLine
+
+	for lineStart := 0; lineStart < len(block); lineNum++ {
+		lineEnd, nextLineStart := lineBounds(block, lineStart)
+		for nextMatch < len(matches) && matches[nextMatch].Line < lineNum {
+			nextMatch++
+		}
+
+		if nextMatch < len(matches) && matches[nextMatch].Line == lineNum {
+			// a match line, so the lines waiting before it are context
+			state.result.Context = append(state.result.Context, state.contextBefore...)
+			state.contextBefore = state.contextBefore[:0]
+			state.contextAfter = afterContext
+		} else if state.contextAfter > 0 {
+			state.result.Context = append(state.result.Context, ContextLine{lineNum, string(block[lineStart:lineEnd])})
+			state.contextAfter--
+		} else if beforeContext > 0 {
+			state.contextBefore = append(state.contextBefore, ContextLine{lineNum, string(block[lineStart:lineEnd])})
+			if int64(len(state.contextBefore)) > beforeContext {
+				state.contextBefore = state.contextBefore[1:]
+			}
+		}
+
+		lineStart = nextLineStart
+	}
+}
+
+// find where the line beginning at lineStart ends and where the one after it begins,
+// "\r\n", "\n" and a lone "\r" each end a line
+func lineBounds(data []byte, lineStart int) (int, int) {
+	lineEnd := bytes.IndexAny(data[lineStart:], "\r\n")
+	if lineEnd == -1 {
+		return len(data), len(data)
+	}
+
+	lineEnd += lineStart
+	if data[lineEnd] == '\r' && lineEnd+1 < len(data) && data[lineEnd+1] == '\n' {
+		return lineEnd, lineEnd + 2
+	}
+	return lineEnd, lineEnd + 1
+}
+
+// check that the match data[start:end] has a word boundary on both sides
+func isWholeWord(data []byte, start, end int) bool {
+	if start > 0 {
+		before, _ := utf8.DecodeLastRune(data[:start])
+		if isWordRune(before) {
+			return false
+		}
+	}
+	if end < len(data) {
+		after, _ := utf8.DecodeRune(data[end:])
+		if isWordRune(after) {
+			return false
+		}
+	}
+	return true
+}
+
+// letters, digits and underscores make up words
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// every job has to end in a record for the aggregator, even when its file can not be opened, and the
+// aggregator only stops once the results channel is closed, so the parallel search has to finish and report
+// the file as an error however the results are sorted rather than waiting on a result that never comes
+func TestSearchFoldersParaUnreadableFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "readable.txt"), []byte("hello world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a socket can not be opened even by root, which ignores file permissions. The walk skips
+	// anything that is not a regular file so it is given as an argument to be searched
+	unreadable := []string{filepath.Join(dir, "socket")}
+	listener, err := net.Listen("unix", unreadable[0])
+	if err != nil {
+		t.Skipf("can not create a socket to search: %v", err)
+	}
+	defer listener.Close()
+
+	if os.Geteuid() != 0 {
+		path := filepath.Join(dir, "no-permission.txt")
+		if err := os.WriteFile(path, []byte("hello\n"), 0000); err != nil {
+			t.Fatal(err)
+		}
+		unreadable = append(unreadable, path)
+	}
+
+	setForTest(t, &searchPatterns, []string{"hello"})
+	setForTest(t, &searchAutomaton, newAhoCorasick(searchPatterns))
+	setForTest(t, &cpuCount, 2)
+	setForTest(t, &typeFlag, "paths")
+	setForTest(t, &formatFlag, "text")
+	setForTest(t, &binaryFlag, "skip")
+	setForTest(t, &noIgnoreFlag, true)
+	setForTest(t, &mmapThresholdFlag, -1)
+	setForTest(t, &fileMatchLimit, -1)
+	setForTest(t, &sortFlag, "none")
+	setArgsForTest(t, dir, unreadable[0])
+
+	for _, sortBy := range []string{"none", "path", "count"} {
+		sortFlag = sortBy
+
+		done := make(chan searchReport)
+		go func() {
+			done <- runSearch(context.Background(), searchFoldersPara)
+		}()
+
+		var report searchReport
+		select {
+		case report = <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("-sort=%s: search did not finish", sortBy)
+		}
+
+		if report.fullCount != 1 {
+			t.Errorf("-sort=%s: found %d occurrences, want 1", sortBy, report.fullCount)
+		}
+		for _, path := range unreadable {
+			found := false
+			for _, searchErr := range report.errors {
+				found = found || searchErr.Path == path
+			}
+			if false == found {
+				t.Errorf("-sort=%s: %s was not reported as an error, got %v", sortBy, path, report.errors)
+			}
+		}
+	}
+}
+
+// set a package variable for the length of the test, the value it had before is put back once it is over
+func setForTest[T any](t *testing.T, variable *T, value T) {
+	previous := *variable
+	*variable = value
+	t.Cleanup(func() {
+		*variable = previous
+	})
+}
+
+// set the arguments to the program for the length of the test
+func setArgsForTest(t *testing.T, args ...string) {
+	previous := flag.Args()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		flag.CommandLine.Parse(previous)
+	})
+}
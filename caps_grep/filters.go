@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+var includeFlags stringListFlag
+var excludeFlags stringListFlag
+var excludeDirFlags stringListFlag
+var extFlags stringListFlag
+
+// check that every glob given to the filter flags is well formed
+func checkFilterGlobs() error {
+	for _, globs := range []stringListFlag{includeFlags, excludeFlags, excludeDirFlags} {
+		for _, glob := range globs {
+			if _, err := filepath.Match(glob, ""); err != nil {
+				return fmt.Errorf("invalid glob \"%s\": %s", glob, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// check if a file found by the walk should be searched, it must match one of the -include
+// globs or -ext extensions when any are given, and none of the -exclude globs
+func includeFile(path string) bool {
+	if len(includeFlags) > 0 || len(extFlags) > 0 {
+		if false == matchesAnyGlob(path, includeFlags) && false == hasAnyExtension(path) {
+			return false
+		}
+	}
+	return false == matchesAnyGlob(path, excludeFlags)
+}
+
+// check if a folder found by the walk should be walked into
+func includeDir(path string) bool {
+	return false == matchesAnyGlob(path, excludeDirFlags)
+}
+
+// globs without a separator are matched against the base name, others against the end of the path
+func matchesAnyGlob(path string, globs []string) bool {
+	for _, glob := range globs {
+		if false == strings.ContainsRune(glob, '/') && false == strings.ContainsRune(glob, filepath.Separator) {
+			if matched, _ := filepath.Match(glob, filepath.Base(path)); matched {
+				return true
+			}
+			continue
+		}
+
+		// try the whole path first then every part of it that follows a separator
+		glob = filepath.ToSlash(glob)
+		target := filepath.ToSlash(path)
+		for {
+			if matched, _ := filepath.Match(glob, target); matched {
+				return true
+			}
+			separator := strings.IndexByte(target, '/')
+			if separator == -1 {
+				break
+			}
+			target = target[separator+1:]
+		}
+	}
+	return false
+}
+
+// check the file extension against the -ext flags, each can hold a comma separated list
+func hasAnyExtension(path string) bool {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	if ext == "" {
+		return false
+	}
+	for _, extList := range extFlags {
+		for _, want := range strings.Split(extList, ",") {
+			if strings.TrimPrefix(strings.TrimSpace(want), ".") == ext {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var noIgnoreFlag bool
+
+// the rules from the global excludes file, relative to each folder given to search
+var globalIgnoreRules []ignoreRule
+
+// a single pattern from a .gitignore style file
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool // pattern started with '!' so a match re-includes the path
+	dirOnly bool // pattern ended with '/' so it only matches folders
+}
+
+// the ignore rules that apply within a folder, chained to the rules of the folders above it
+type ignoreMatcher struct {
+	parent  *ignoreMatcher
+	baseDir string
+	rules   []ignoreRule
+}
+
+// the matcher to start walking the folder "root" with, nil when ignore files are turned off
+func newRootIgnoreMatcher(root string) *ignoreMatcher {
+	if noIgnoreFlag {
+		return nil
+	}
+	return &ignoreMatcher{baseDir: root, rules: globalIgnoreRules}
+}
+
+// the matcher for the folder "dir" found below the folder of "m", adding the rules
+// from its .gitignore, .ignore and, at the top of a repository, .git/info/exclude
+func (m *ignoreMatcher) forDir(dir string) *ignoreMatcher {
+	if m == nil {
+		return nil
+	}
+
+	var rules []ignoreRule
+	for _, name := range []string{".git/info/exclude", ".gitignore", ".ignore"} {
+		rules = append(rules, readIgnoreFile(filepath.Join(dir, name))...)
+	}
+	if len(rules) == 0 {
+		return m
+	}
+
+	return &ignoreMatcher{parent: m, baseDir: dir, rules: rules}
+}
+
+// check if the path should be skipped, rules in deeper folders win over those above them
+// and later rules in a file win over earlier ones
+func (m *ignoreMatcher) ignored(path string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	if isDir && filepath.Base(path) == ".git" {
+		return true
+	}
+
+	for level := m; level != nil; level = level.parent {
+		relPath, err := filepath.Rel(level.baseDir, path)
+		if err != nil {
+			continue
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		for i := len(level.rules) - 1; i >= 0; i-- {
+			rule := level.rules[i]
+			if rule.dirOnly && false == isDir {
+				continue
+			}
+			if rule.pattern.MatchString(relPath) {
+				return false == rule.negate
+			}
+		}
+	}
+
+	return false
+}
+
+// read the global excludes file named by core.excludesFile in the git config,
+// or the default one in the git config folder
+func loadGlobalIgnoreRules() {
+	if noIgnoreFlag {
+		return
+	}
+
+	home, _ := os.UserHomeDir()
+	excludesFile := ""
+
+	// look for core.excludesFile in the users git config
+	if home != "" {
+		inCore := false
+		for _, line := range readLines(filepath.Join(home, ".gitconfig")) {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "[") {
+				inCore = strings.EqualFold(strings.Trim(line, "[] "), "core")
+				continue
+			}
+			keyValue := strings.SplitN(line, "=", 2)
+			if inCore && len(keyValue) == 2 && strings.EqualFold(strings.TrimSpace(keyValue[0]), "excludesfile") {
+				excludesFile = strings.Trim(strings.TrimSpace(keyValue[1]), `"`)
+			}
+		}
+	}
+
+	if excludesFile == "" {
+		configDir := os.Getenv("XDG_CONFIG_HOME")
+		if configDir == "" && home != "" {
+			configDir = filepath.Join(home, ".config")
+		}
+		if configDir == "" {
+			return
+		}
+		excludesFile = filepath.Join(configDir, "git", "ignore")
+	} else if strings.HasPrefix(excludesFile, "~/") && home != "" {
+		excludesFile = filepath.Join(home, excludesFile[2:])
+	}
+
+	globalIgnoreRules = readIgnoreFile(excludesFile)
+}
+
+// read the rules from an ignore file, a missing or unreadable file has no rules
+func readIgnoreFile(path string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range readLines(path) {
+		if rule, ok := parseIgnoreRule(line); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func readLines(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// turn one line of an ignore file into a rule, following the gitignore pattern format
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	var rule ignoreRule
+
+	line = strings.TrimRight(line, "\r")
+	if line == "" || line[0] == '#' {
+		return rule, false
+	}
+
+	// trailing spaces are dropped unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && false == strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" {
+		return rule, false
+	}
+
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+
+	// a separator at the start or in the middle ties the pattern to the folder of the ignore file,
+	// otherwise it can match at any depth below it
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expression := "^"
+	if false == anchored {
+		expression += "(?:.*/)?"
+	}
+	expression += ignoreGlobToRegexp(line) + "$"
+
+	pattern, err := regexp.Compile(expression)
+	if err != nil {
+		return rule, false
+	}
+	rule.pattern = pattern
+	return rule, true
+}
+
+// convert a gitignore glob to a regular expression, "*" and "?" never match a separator
+// while "**" between separators matches any number of folders
+func ignoreGlobToRegexp(glob string) string {
+	var expression strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		atSegmentStart := i == 0 || glob[i-1] == '/'
+
+		switch {
+		case atSegmentStart && strings.HasPrefix(glob[i:], "**/"):
+			expression.WriteString("(?:.*/)?")
+			i += 2
+
+		case atSegmentStart && glob[i:] == "**":
+			expression.WriteString(".*")
+			i++
+
+		case glob[i] == '*':
+			expression.WriteString("[^/]*")
+
+		case glob[i] == '?':
+			expression.WriteString("[^/]")
+
+		case glob[i] == '[':
+			// find the end of the character class, a ']' straight after the opening is part of it
+			end := i + 1
+			if end < len(glob) && glob[end] == '!' {
+				end++
+			}
+			if end < len(glob) && glob[end] == ']' {
+				end++
+			}
+			for end < len(glob) && glob[end] != ']' {
+				end++
+			}
+			if end >= len(glob) {
+				expression.WriteString(`\[`)
+				continue
+			}
+
+			class := glob[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expression.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i = end
+
+		case glob[i] == '\\' && i+1 < len(glob):
+			expression.WriteString(regexp.QuoteMeta(glob[i+1 : i+2]))
+			i++
+
+		default:
+			expression.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+
+	return expression.String()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob, expression string
+	}{
+		{"name", `name`},
+		{"*.go", `[^/]*\.go`},
+		{"a?c", `a[^/]c`},
+		{"**/foo", `(?:.*/)?foo`},
+		{"foo/**", `foo/.*`},
+		{"a/**/b", `a/(?:.*/)?b`},
+		{"foo**bar", `foo[^/]*[^/]*bar`},
+		{"[abc].txt", `[abc]\.txt`},
+		{"[!a]x", `[^a]x`},
+		{"[]a]", `[]a]`},
+		{"[a-z]", `[a-z]`},
+		{"[abc", `\[abc`},
+		{`\*x`, `\*x`},
+		{`a\b`, `ab`},
+		{"a+b(c)", `a\+b\(c\)`},
+	}
+
+	for _, test := range tests {
+		if expression := ignoreGlobToRegexp(test.glob); expression != test.expression {
+			t.Errorf("ignoreGlobToRegexp(%q) = %q, want %q", test.glob, expression, test.expression)
+		}
+	}
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		path    string // relative to the folder of the ignore file
+		isDir   bool
+		matches bool
+		negate  bool
+	}{
+		{"*.log", "x.log", false, true, false},
+		{"*.log", "a/b/x.log", false, true, false},
+		{"*.log", "x.log.txt", false, false, false},
+		{"/build", "build", true, true, false},
+		{"/build", "sub/build", true, false, false},
+		{"build/", "build", true, true, false},
+		{"build/", "build", false, false, false},
+		{"build/", "sub/build", true, true, false},
+		{"doc/*.txt", "doc/a.txt", false, true, false},
+		{"doc/*.txt", "doc/x/a.txt", false, false, false},
+		{"doc/*.txt", "sub/doc/a.txt", false, false, false},
+		{"**/tmp", "tmp", true, true, false},
+		{"**/tmp", "a/b/tmp", true, true, false},
+		{"a/**/b", "a/b", false, true, false},
+		{"a/**/b", "a/x/y/b", false, true, false},
+		{"a/**", "a/x/y", false, true, false},
+		{"a/**", "a", true, false, false},
+		{"!keep.log", "keep.log", false, true, true},
+		{`\!keep.log`, "!keep.log", false, true, false},
+		{`\#hash`, "#hash", false, true, false},
+		{"trailing  ", "trailing", false, true, false},
+		{`space\ `, "space ", false, true, false},
+		{"crlf\r", "crlf", false, true, false},
+		{"[!a]b", "cb", false, true, false},
+		{"[!a]b", "ab", false, false, false},
+	}
+
+	for _, test := range tests {
+		rule, ok := parseIgnoreRule(test.line)
+		if false == ok {
+			t.Errorf("parseIgnoreRule(%q) gave no rule", test.line)
+			continue
+		}
+		matches := rule.pattern.MatchString(test.path) && (test.isDir || false == rule.dirOnly)
+		if matches != test.matches || rule.negate != test.negate {
+			t.Errorf("rule %q on %q (folder %v): matches %v negate %v, want %v %v",
+				test.line, test.path, test.isDir, matches, rule.negate, test.matches, test.negate)
+		}
+	}
+
+	for _, line := range []string{"", "# comment", "!", "/", "   "} {
+		if _, ok := parseIgnoreRule(line); ok {
+			t.Errorf("parseIgnoreRule(%q) gave a rule, want none", line)
+		}
+	}
+}
+
+// the rules of deeper folders win over those above them and later rules in a file win over earlier ones
+func TestIgnoredPrecedence(t *testing.T) {
+	setForTest(t, &noIgnoreFlag, false)
+	setForTest(t, &globalIgnoreRules, nil)
+
+	root := t.TempDir()
+	sub := filepath.Join(root, "sub")
+	deeper := filepath.Join(sub, "deeper")
+	if err := os.MkdirAll(deeper, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ignoreFiles := map[string]string{
+		filepath.Join(root, ".gitignore"):   "*.log\n!keep.log\nbuild/\n/top.txt\nlater.txt\n!later.txt\n!sooner.txt\nsooner.txt\n",
+		filepath.Join(sub, ".gitignore"):    "!important.log\nkeep.log\n",
+		filepath.Join(deeper, ".ignore"):    "!keep.log\n",
+		filepath.Join(deeper, ".gitignore"): "*.txt\n",
+	}
+	for path, rules := range ignoreFiles {
+		if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rootMatcher := newRootIgnoreMatcher(root).forDir(root)
+	subMatcher := rootMatcher.forDir(sub)
+	deeperMatcher := subMatcher.forDir(deeper)
+
+	tests := []struct {
+		matcher *ignoreMatcher
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{rootMatcher, "a.log", false, true},
+		{rootMatcher, "keep.log", false, false},
+		{rootMatcher, "build", true, true},
+		{rootMatcher, "build", false, false},
+		{rootMatcher, ".git", true, true},
+		{rootMatcher, "top.txt", false, true},
+		{rootMatcher, "later.txt", false, false},
+		{rootMatcher, "sooner.txt", false, true},
+		{subMatcher, "sub/other.log", false, true},
+		{subMatcher, "sub/important.log", false, false},
+		{subMatcher, "sub/keep.log", false, true},
+		{subMatcher, "sub/top.txt", false, false},
+		{subMatcher, "sub/build", true, true},
+		{deeperMatcher, "sub/deeper/keep.log", false, false},
+		{deeperMatcher, "sub/deeper/other.log", false, true},
+		{deeperMatcher, "sub/deeper/later.txt", false, true},
+		{deeperMatcher, "sub/deeper/notes.md", false, false},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(root, filepath.FromSlash(test.path))
+		if ignored := test.matcher.ignored(path, test.isDir); ignored != test.ignored {
+			t.Errorf("ignored(%q, folder %v) = %v, want %v", test.path, test.isDir, ignored, test.ignored)
+		}
+	}
+}
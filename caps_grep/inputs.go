@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+)
+
+// the argument that stands for standard input, and the name its results are given, as grep does
+const stdinArg = "-"
+const stdinPath = "(standard input)"
+
+// call visit with each path to search, the arguments to the program or with -type=files
+// the list of paths read from standard input, until the context is cancelled. Returns any
+// error reading the list. Standard input can only be searched as an argument, in the list
+// it already holds the list so "-" is a file with that name.
+func eachSearchPath(ctx context.Context, visit func(path string)) error {
+	if typeFlag != "files" {
+		for _, path := range flag.Args() {
+			if ctx.Err() != nil {
+				return nil
+			}
+			visit(path)
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(contextReader{ctx, os.Stdin})
+	scanner.Split(pathListSplitter())
+	for scanner.Scan() {
+		path := scanner.Text()
+		if path == stdinArg {
+			path = "." + string(filepath.Separator) + stdinArg
+		}
+		if path != "" {
+			visit(path)
+		}
+	}
+	return scanner.Err()
+}
+
+// split a list of paths on NUL bytes when the first separator is a NUL, as find -print0 writes them,
+// otherwise on line breaks
+func pathListSplitter() bufio.SplitFunc {
+	separator := -1
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if separator == -1 {
+			if sepIdx := bytes.IndexAny(data, "\x00\n"); sepIdx != -1 {
+				separator = int(data[sepIdx])
+			}
+		}
+
+		if separator != -1 {
+			if sepIdx := bytes.IndexByte(data, byte(separator)); sepIdx != -1 {
+				return sepIdx + 1, trimPathListEntry(data[:sepIdx], separator), nil
+			}
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), trimPathListEntry(data, separator), nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// a list written on windows ends each line with "\r\n"
+func trimPathListEntry(entry []byte, separator int) []byte {
+	if separator != 0 {
+		return bytes.TrimSuffix(entry, []byte{'\r'})
+	}
+	return entry
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// memory mapping is only done on unix systems, elsewhere files are always read
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("memory mapping is not supported on this platform")
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
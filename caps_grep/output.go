@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// a match as written by the json and jsonl output formats
+type jsonMatch struct {
+	Type       string `json:"type,omitempty"`
+	File       string `json:"file"`
+	Line       int64  `json:"line"`
+	Column     int64  `json:"column"`
+	RuneColumn int64  `json:"rune_column"`
+	Pattern    string `json:"pattern"`
+	Text       string `json:"text"`
+}
+
+// a file listed by -l or -L as written by the jsonl output format
+type jsonFile struct {
+	Type string `json:"type"`
+	File string `json:"file"`
+}
+
+// the occurrences of one search string as written by the json and jsonl output formats, left out with
+// -l and -L as they stop at the first match in each file
+type jsonPatternCount struct {
+	Pattern     string `json:"pattern"`
+	Occurrences *int64 `json:"occurrences,omitempty"`
+}
+
+// a file or folder that could not be searched as written by the json and jsonl output formats
+type jsonError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// the totals of a search run as written by the json and jsonl output formats
+type jsonSummary struct {
+	Type              string             `json:"type,omitempty"`
+	Patterns          []jsonPatternCount `json:"patterns"`
+	Occurrences       *int64             `json:"occurrences,omitempty"`
+	FilesMatched      *int64             `json:"files_matched,omitempty"` // given instead of occurrences with -l and -L
+	CharactersScanned int64              `json:"characters_scanned"`
+	FilesScanned      int64              `json:"files_scanned"`
+	BinaryFiles       int64              `json:"binary_files"`
+	MappedFiles       int64              `json:"memory_mapped_files"`
+	Errors            []jsonError        `json:"errors"`
+	Cancelled         string             `json:"cancelled,omitempty"`
+	ElapsedSeconds    float64            `json:"elapsed_seconds"`
+	CharsPerSecond    float64            `json:"characters_per_second"`
+	FilesPerSecond    float64            `json:"files_per_second"`
+}
+
+// number of matches, or files listed by -l or -L, written so far in the json format, used to place the separating commas
+var jsonItemsWritten int64
+
+// if name was qualified chop it down to the base / shorten if need be
+func shortFileName(path string) string {
+	fileName := filepath.Base(path)
+	if len(fileName) > 25 {
+		fileName = fileName[:25] + "..."
+	}
+	return fileName
+}
+
+// show the file that is about to be searched, kept off stdout when it would break json output
+func printProgress(path string) {
+	if false == progressFlag || quietFlag {
+		return
+	}
+	progress := fmt.Sprintf("Searching file: %s \n", shortFileName(path))
+	if formatFlag == "text" {
+		fmt.Print(progress)
+	} else {
+		fmt.Fprint(os.Stderr, progress)
+	}
+}
+
+// shows file results in the order -sort asks for, either as they are added, in walk order holding back
+// the results that arrive before those of the files found ahead of them, or by their occurrences once
+// every file has been searched
+type resultPrinter struct {
+	sortBy  string
+	nextSeq int64               // the job whose results are to be shown next in walk order
+	waiting map[int64]jobResult // results held back waiting for the jobs ahead of them
+	held    []FileResult        // results held back to be sorted by occurrences
+	window  semaphore           // a place is freed in it each time a result is shown in walk order
+	printed bool                // lines of a file have been shown, so those of the next file are put after a separator
+}
+
+func newResultPrinter(sortBy string, window semaphore) *resultPrinter {
+	return &resultPrinter{sortBy: sortBy, waiting: make(map[int64]jobResult), window: window}
+}
+
+// show a job result or hold it back until it can be shown in order
+func (p *resultPrinter) add(jr jobResult) {
+	switch p.sortBy {
+	case "path":
+		p.waiting[jr.seq] = jr
+		for {
+			next, found := p.waiting[p.nextSeq]
+			if false == found {
+				return
+			}
+			delete(p.waiting, p.nextSeq)
+			p.nextSeq++
+			p.show(next)
+			if p.window != nil {
+				<-p.window
+			}
+		}
+
+	case "count":
+		if jr.searched {
+			p.held = append(p.held, jr.result)
+		}
+
+	default:
+		p.show(jr)
+	}
+}
+
+// show the results still held back once every job result has been added, results can still be waiting
+// in walk order if the search was cancelled before the files ahead of them were searched
+func (p *resultPrinter) flush() {
+	waitingSeqs := []int64{}
+	for seq := range p.waiting {
+		waitingSeqs = append(waitingSeqs, seq)
+	}
+	sort.Slice(waitingSeqs, func(i, j int) bool {
+		return waitingSeqs[i] < waitingSeqs[j]
+	})
+	for _, seq := range waitingSeqs {
+		p.show(p.waiting[seq])
+	}
+	p.waiting = make(map[int64]jobResult)
+
+	// files with the same number of occurrences are kept in walk order
+	sort.SliceStable(p.held, func(i, j int) bool {
+		if p.held[i].Occurrences != p.held[j].Occurrences {
+			return p.held[i].Occurrences > p.held[j].Occurrences
+		}
+		return walkOrderLess(p.held[i].Path, p.held[j].Path)
+	})
+	for _, result := range p.held {
+		p.printMatches(result)
+		printFileCount(result)
+	}
+	p.held = nil
+}
+
+func (p *resultPrinter) show(jr jobResult) {
+	if jr.searched {
+		p.printMatches(jr.result)
+		printFileCount(jr.result)
+	}
+}
+
+// compare paths a folder at a time, which is the order the walk finds them in, by making
+// the separators sort before any other character
+func walkOrderLess(a, b string) bool {
+	separator := string(filepath.Separator)
+	return strings.Replace(a, separator, "\x00", -1) < strings.Replace(b, separator, "\x00", -1)
+}
+
+// print the matches in a file result in the selected output format, or with -l and -L its path if it is listed
+func (p *resultPrinter) printMatches(result FileResult) {
+	if quietFlag {
+		return
+	}
+	if filesWithMatchesFlag || filesWithoutMatchesFlag {
+		printListedFile(result)
+		return
+	}
+
+	switch formatFlag {
+	case "json":
+		for _, match := range result.Matches {
+			printJSONListItem(mustMarshal(newJSONMatch(match, "")))
+		}
+
+	case "jsonl":
+		var outputBuffer bytes.Buffer
+		for _, match := range result.Matches {
+			outputBuffer.WriteString(mustMarshal(newJSONMatch(match, "match")) + "\n")
+		}
+		fmt.Print(outputBuffer.String())
+
+	default:
+		if verboseFlag {
+			lines := formatMatches(result, p.printed)
+			fmt.Print(lines)
+			p.printed = p.printed || lines != ""
+		}
+	}
+}
+
+// print the path of a file result if it is one that -l or -L lists
+func printListedFile(result FileResult) {
+	if false == isListed(result) {
+		return
+	}
+
+	switch formatFlag {
+	case "json":
+		printJSONListItem(mustMarshal(result.Path))
+	case "jsonl":
+		fmt.Print(mustMarshal(jsonFile{Type: "file", File: result.Path}) + "\n")
+	default:
+		fmt.Print(result.Path + "\n")
+	}
+}
+
+// check if a file result is one that -l or -L lists, skipped binary files are never listed
+func isListed(result FileResult) bool {
+	if result.Binary && binaryFlag == "skip" {
+		return false
+	}
+	return (filesWithMatchesFlag && result.Occurrences > 0) || (filesWithoutMatchesFlag && result.Occurrences == 0)
+}
+
+// write an item of the list of matches, or of files with -l and -L, in the json format
+func printJSONListItem(item string) {
+	if jsonItemsWritten == 0 {
+		fmt.Print(fmt.Sprintf("{\"%s\":[", jsonListName()))
+	} else {
+		fmt.Print(",")
+	}
+	fmt.Print(item)
+	jsonItemsWritten++
+}
+
+// the name of the list in the json format, the files that -l or -L list or the matches
+func jsonListName() string {
+	if filesWithMatchesFlag || filesWithoutMatchesFlag {
+		return "files"
+	}
+	return "matches"
+}
+
+// print how many occurrences a file result had, only shown in the text format and not with -l or -L
+// where the paths are all that is printed
+func printFileCount(result FileResult) {
+	if fileMapFlag && formatFlag == "text" && false == quietFlag && false == filesWithMatchesFlag && false == filesWithoutMatchesFlag {
+		fmt.Print(formatFileCount(result))
+	}
+}
+
+// print the totals of a single search run in the selected output format
+func printReport(title string, report searchReport) {
+	if quietFlag {
+		return
+	}
+
+	switch formatFlag {
+	case "json":
+		if jsonItemsWritten == 0 {
+			fmt.Print(fmt.Sprintf("{\"%s\":[", jsonListName()))
+		}
+		fmt.Print(fmt.Sprintf("],\"summary\":%s}\n", mustMarshal(newJSONSummary(report, ""))))
+
+	case "jsonl":
+		fmt.Print(mustMarshal(newJSONSummary(report, "summary")) + "\n")
+
+	default:
+		// the paths listed by -l and -L are left on their own so they can be used by other programs
+		if filesWithMatchesFlag || filesWithoutMatchesFlag {
+			return
+		}
+		printTextReport(title, report)
+	}
+}
+
+// print the totals of a single search run under the given title
+func printTextReport(title string, report searchReport) {
+	fmt.Print(fmt.Sprintf("\n%s\n", title))
+	fmt.Print("---------------------\n")
+	if report.cancelled != "" {
+		fmt.Print(fmt.Sprintf("Search %s before it finished, the results are partial \n", report.cancelled))
+	}
+	if len(searchPatterns) == 1 {
+		fmt.Print(fmt.Sprintf("Search string: \"%s\" Total occurrences: %d \n", searchPatterns[0], report.fullCount))
+	} else {
+		fmt.Print(fmt.Sprintf("Search strings: %d Total occurrences: %d \n", len(searchPatterns), report.fullCount))
+		for patternIdx, pattern := range searchPatterns {
+			fmt.Print(fmt.Sprintf("  \"%s\" occurrences: %d \n", pattern, report.patternCounts[patternIdx]))
+		}
+	}
+	fmt.Print(fmt.Sprintf("Characters scanned: %d \n", report.charCount))
+	fmt.Print(fmt.Sprintf("Files scanned: %d \n", report.fileCount))
+	fmt.Print(fmt.Sprintf("Files read: %d, memory mapped: %d \n", report.readFiles, report.mappedFiles))
+	if binaryFlag == "skip" {
+		fmt.Print(fmt.Sprintf("Binary files skipped: %d \n", report.binaryFiles))
+	} else if binaryFlag == "count-only" {
+		fmt.Print(fmt.Sprintf("Binary files counted only: %d \n", report.binaryFiles))
+	}
+	if len(report.errors) > 0 {
+		fmt.Print(fmt.Sprintf("Files or folders that could not be searched: %d \n", len(report.errors)))
+		for _, searchErr := range report.errors {
+			fmt.Print(fmt.Sprintf("  %s : %s \n", searchErr.Path, searchErr.Reason))
+		}
+	}
+	fmt.Print(fmt.Sprintf("Time elasped: %s \n", report.elasped))
+	fmt.Print(fmt.Sprintf("Characters per second: %.5f \n", report.charsPerSecond()))
+	fmt.Print(fmt.Sprintf("Files per second: %.5f \n", report.filesPerSecond()))
+}
+
+// format each match in a file result as a line of verbose output, along with any context lines
+// around them, putting a separator between groups of lines that are not next to each other. When
+// context is shown the first group is also separated from the lines of a file shown before it.
+func formatMatches(result FileResult, printedBefore bool) string {
+	var outputBuffer bytes.Buffer
+	fileName := shortFileName(result.Path)
+	var lastLine int64
+	contextIdx := 0
+
+	writeSeparator := func(line int64) {
+		if lastLine == 0 && printedBefore && (afterContext > 0 || beforeContext > 0) {
+			outputBuffer.WriteString("--\n")
+		} else if len(result.Context) > 0 && lastLine > 0 && line > lastLine+1 {
+			outputBuffer.WriteString("--\n")
+		}
+		lastLine = line
+	}
+	writeContextUpTo := func(line int64) {
+		for contextIdx < len(result.Context) && result.Context[contextIdx].Line < line {
+			context := result.Context[contextIdx]
+			writeSeparator(context.Line)
+			outputBuffer.WriteString(fmt.Sprintf("Context in :%s line: %d, %s \n", fileName, context.Line, context.Text))
+			contextIdx++
+		}
+	}
+
+	for _, match := range result.Matches {
+		writeContextUpTo(match.Line)
+		writeSeparator(match.Line)
+		if len(searchPatterns) > 1 {
+			outputBuffer.WriteString(fmt.Sprintf("Match of \"%s\" in :%s line: %d, pos: %d, char: %d, %s \n", match.Pattern, fileName, match.Line, match.Column, match.RuneColumn, match.LineText))
+		} else {
+			outputBuffer.WriteString(fmt.Sprintf("Match in :%s line: %d, pos: %d, char: %d, %s \n", fileName, match.Line, match.Column, match.RuneColumn, match.LineText))
+		}
+	}
+	writeContextUpTo(math.MaxInt64)
+
+	return outputBuffer.String()
+}
+
+// format the number of occurrences found in a file result
+func formatFileCount(result FileResult) string {
+	if result.Binary && binaryFlag == "skip" {
+		return fmt.Sprintf("%s : binary file skipped\n", shortFileName(result.Path))
+	}
+	// the benchmark shows how each file was searched to help tune -mmap-threshold
+	if methodFLag == "bench" {
+		return fmt.Sprintf("%s : %d occurrences (%s)\n", shortFileName(result.Path), result.Occurrences, result.ReadMethod)
+	}
+	return fmt.Sprintf("%s : %d occurrences\n", shortFileName(result.Path), result.Occurrences)
+}
+
+func newJSONMatch(match Match, recordType string) jsonMatch {
+	return jsonMatch{
+		Type:       recordType,
+		File:       match.Path,
+		Line:       match.Line,
+		Column:     match.Column,
+		RuneColumn: match.RuneColumn,
+		Pattern:    match.Pattern,
+		Text:       match.LineText,
+	}
+}
+
+// make the summary of a search run, with -l and -L a file stops at its first match so the number of files
+// with a match is given rather than counts of occurrences that would fall short
+func newJSONSummary(report searchReport, recordType string) jsonSummary {
+	listing := filesWithMatchesFlag || filesWithoutMatchesFlag
+	patterns := make([]jsonPatternCount, len(searchPatterns))
+	for patternIdx, pattern := range searchPatterns {
+		patterns[patternIdx] = jsonPatternCount{Pattern: pattern}
+		if false == listing {
+			patterns[patternIdx].Occurrences = &report.patternCounts[patternIdx]
+		}
+	}
+	errors := make([]jsonError, len(report.errors))
+	for errorIdx, searchErr := range report.errors {
+		errors[errorIdx] = jsonError{searchErr.Path, searchErr.Reason}
+	}
+
+	summary := jsonSummary{
+		Type:              recordType,
+		Patterns:          patterns,
+		CharactersScanned: report.charCount,
+		FilesScanned:      report.fileCount,
+		BinaryFiles:       report.binaryFiles,
+		MappedFiles:       report.mappedFiles,
+		Errors:            errors,
+		Cancelled:         report.cancelled,
+		ElapsedSeconds:    report.elasped.Seconds(),
+		CharsPerSecond:    report.charsPerSecond(),
+		FilesPerSecond:    report.filesPerSecond(),
+	}
+	if listing {
+		summary.FilesMatched = &report.matchedFiles
+	} else {
+		summary.Occurrences = &report.fullCount
+	}
+	return summary
+}
+
+// encode a value as json, the records written here only hold plain fields so this can not fail
+func mustMarshal(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	check(err)
+	return string(encoded)
+}
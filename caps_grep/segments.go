@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// size in bytes of the segments a memory mapped file is split into so the parallel method can search it
+// on more than one CPU at once, 0 never splits files
+var segmentSizeFlag int64
+
+// a part of a file that is in memory, the matches that start in data[start:end] belong to it
+type segment struct {
+	start, end   int
+	lineBreaks   int64        // line breaks within data[start:end]
+	state        *searchState // results of searching the segment, with lines counted from 0
+	lastMatchEnd []int        // where the last match of each pattern in the segment ended
+}
+
+// search data that is already in memory by splitting it into segments of about -segment-size bytes and
+// searching up to "routines" of them at once. Each segment is searched as if it started on line 0, the line
+// it really starts on is worked out afterwards from the line breaks counted in the segments before it.
+// Once the context is cancelled no more segments are started and the error of the context is returned.
+func searchMemorySplit(ctx context.Context, matcher *ahoCorasick, data []byte, path string, routines int) (FileResult, error) {
+	state := newSearchState(path)
+	if state.checkBinary(data) {
+		return skippedBinaryResult(path), nil
+	}
+
+	segments := splitSegments(data, int(segmentSizeFlag))
+
+	var wg sync.WaitGroup
+	searchingSem := make(semaphore, routines)
+	for i := 0; i < len(segments) && ctx.Err() == nil; i++ {
+		wg.Add(1)
+		searchingSem <- empty{}
+		go func(seg *segment) {
+			defer wg.Done()
+			seg.lineBreaks = countLineBreaks(data, seg.start, seg.end)
+			seg.search(matcher, data, state, make([]int, len(searchPatterns)))
+			<-searchingSem
+		}(&segments[i])
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return state.finish(), err
+	}
+
+	// put the segments back together in order, the lines of each are moved along by the
+	// total number of line breaks before it
+	lastMatchEnd := make([]int, len(searchPatterns))
+	for i := range segments {
+		seg := &segments[i]
+
+		// a match that ran on into this segment stops the same pattern matching again until it is over,
+		// the segment was searched without knowing that so it has to be searched again
+		if searchRegexes == nil && endsAfter(lastMatchEnd, seg.start) {
+			seg.search(matcher, data, state, lastMatchEnd)
+		}
+		copy(lastMatchEnd, seg.lastMatchEnd)
+
+		for _, match := range seg.state.result.Matches {
+			match.Line += state.lineNum
+			state.result.Matches = append(state.result.Matches, match)
+		}
+		for patternIdx, count := range seg.state.result.PatternCounts {
+			state.result.PatternCounts[patternIdx] += count
+		}
+		state.lineNum += seg.lineBreaks
+	}
+
+	state.collectContext(data, 1, state.result.Matches)
+	state.result.CharCount = int64(len(data))
+	return state.finish(), nil
+}
+
+// search the segment on its own, "lastMatchEnd" is where the last match of each pattern before it ended
+func (seg *segment) search(matcher *ahoCorasick, data []byte, fileState *searchState, lastMatchEnd []int) {
+	seg.state = &searchState{
+		result:    FileResult{Path: fileState.result.Path, PatternCounts: make([]int64, len(searchPatterns))},
+		countOnly: fileState.countOnly,
+	}
+	seg.lastMatchEnd = append([]int{}, lastMatchEnd...)
+
+	if searchRegexes != nil {
+		seg.state.offset = int64(seg.start)
+		seg.state.searchRegexLines(searchRegexes, data[seg.start:seg.end])
+	} else {
+		seg.state.searchAutomatonRange(matcher, data, seg.start, seg.end, seg.lastMatchEnd)
+	}
+}
+
+// split the data into segments of about "size" bytes. The automaton reads past the end of a segment by
+// the length of the longest search string less one, so segments can end anywhere, but an expression
+// could match any amount of a line so for those every segment ends at the end of a line.
+func splitSegments(data []byte, size int) []segment {
+	segments := []segment{}
+
+	for start := 0; start < len(data); {
+		end := start + size
+		if end >= len(data) {
+			end = len(data)
+		} else if searchRegexes != nil && false == isLineStart(data, end) {
+			_, end = lineBounds(data, end)
+		}
+
+		segments = append(segments, segment{start: start, end: end})
+		start = end
+	}
+
+	return segments
+}
+
+// check if a line begins at data[pos]
+func isLineStart(data []byte, pos int) bool {
+	if pos == 0 {
+		return true
+	}
+	switch data[pos-1] {
+	case '\n':
+		return true
+	case '\r':
+		return data[pos] != '\n'
+	}
+	return false
+}
+
+// count the line breaks in data[start:end] the same way the search does, "\r\n" is one line break
+// that is counted at the '\r' so a segment starting between the two does not count it again
+func countLineBreaks(data []byte, start, end int) int64 {
+	block := data[start:end]
+	lineBreaks := bytes.Count(block, []byte{'\r'}) + bytes.Count(block, []byte{'\n'}) - bytes.Count(block, []byte("\r\n"))
+	if start > 0 && len(block) > 0 && data[start-1] == '\r' && block[0] == '\n' {
+		lineBreaks--
+	}
+	return int64(lineBreaks)
+}
+
+// check if the match of any pattern ends after "pos"
+func endsAfter(lastMatchEnd []int, pos int) bool {
+	for _, end := range lastMatchEnd {
+		if end > pos {
+			return true
+		}
+	}
+	return false
+}
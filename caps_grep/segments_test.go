@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// splitting a file into segments as small as a single byte has to give the same results as searching it whole,
+// whatever the segments cut through: matches, line breaks, "\r\n" or multi-byte runes
+func TestSearchMemorySplitMatchesWholeSearch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		regex    bool
+		word     bool
+		data     string
+	}{
+		{"lines", []string{"foo"}, false, false, "foo bar\nbar foo foo\n\nfoofoo\nlast foo"},
+		{"crlf", []string{"foo"}, false, false, "foo\r\nbar\r\n\r\nfoo\rfoo\r\r\nfoo\n\rfoo"},
+		{"long pattern", []string{"abcdefghij"}, false, false, "xxabcdefghijxx\nabcdefghijabcdefghij\nabcdefghi\njabcdefghij"},
+		{"overlapping prefix", []string{"aab"}, false, false, "aaab aab aaaab\naab"},
+		{"same pattern runs on", []string{"aa"}, false, false, "aaaaa\naaa aa\na\naaaaaa"},
+		{"prefix ends later", []string{"abab", "a"}, false, false, "xabab\nababab a\nabab"},
+		{"several patterns", []string{"he", "she", "his", "hers"}, false, false, "ushers\nhishe hers she\nshehis"},
+		{"runes", []string{"föö", "日本"}, false, false, "日本föö\nxföö日本föö\n日本\n"},
+		{"whole words", []string{"foo"}, false, true, "foo foobar barfoo foo_x (foo) föo foo\nfoo\r\nxfoo foo"},
+		{"regex", []string{"fo+", "b.r"}, true, false, "foo bar\nfooo\r\nbor bar fo\n\nxfo"},
+		{"regex words", []string{"fo+"}, true, true, "foo foox xfoo\nfoo\rfoo"},
+	}
+
+	setForTest(t, &binaryFlag, "text")
+	setForTest(t, &fileMatchLimit, -1)
+	setForTest(t, &verboseFlag, true)
+	setForTest(t, &afterContext, 1)
+	setForTest(t, &beforeContext, 1)
+
+	for _, test := range tests {
+		setForTest(t, &searchPatterns, test.patterns)
+		setForTest(t, &wordFlag, test.word)
+		setForTest(t, &searchRegexes, nil)
+		if test.regex {
+			for _, pattern := range test.patterns {
+				searchRegexes = append(searchRegexes, regexp.MustCompile(pattern))
+			}
+		}
+		matcher := newAhoCorasick(test.patterns)
+		data := []byte(test.data)
+
+		want, err := searchMemory(context.Background(), matcher, data, "file")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if want.Occurrences == 0 {
+			t.Fatalf("%s: nothing found to compare", test.name)
+		}
+
+		for size := 1; size <= len(data); size++ {
+			setForTest(t, &segmentSizeFlag, int64(size))
+
+			got, err := searchMemorySplit(context.Background(), matcher, data, "file", 3)
+			if err != nil {
+				t.Fatalf("%s: segment size %d: %v", test.name, size, err)
+			}
+			if false == reflect.DeepEqual(got, want) {
+				t.Errorf("%s: segment size %d:\n got %+v\nwant %+v", test.name, size, got, want)
+			}
+		}
+	}
+}
+
+func TestCountLineBreaks(t *testing.T) {
+	data := []byte("a\r\nb\rc\nd\r\n\r\ne")
+	total := int64(strings.Count(string(data), "\r") + strings.Count(string(data), "\n") - strings.Count(string(data), "\r\n"))
+
+	// the counts of the segments add up to the count of the whole, however it is split
+	for size := 1; size <= len(data); size++ {
+		var sum int64
+		for start := 0; start < len(data); start += size {
+			end := start + size
+			if end > len(data) {
+				end = len(data)
+			}
+			sum += countLineBreaks(data, start, end)
+		}
+		if sum != total {
+			t.Errorf("segment size %d: counted %d line breaks, want %d", size, sum, total)
+		}
+	}
+}
+
+func TestSplitSegmentsRegexLineStarts(t *testing.T) {
+	setForTest(t, &searchRegexes, []*regexp.Regexp{regexp.MustCompile("x")})
+
+	data := []byte("one\r\ntwo\rthree\nfour")
+	for size := 1; size <= len(data); size++ {
+		segments := splitSegments(data, size)
+		for i, seg := range segments {
+			if false == isLineStart(data, seg.start) {
+				t.Errorf("segment size %d: segment %d starts at %d, which is not the start of a line", size, i, seg.start)
+			}
+			if i > 0 && segments[i-1].end != seg.start {
+				t.Errorf("segment size %d: segment %d does not start where the one before ends", size, i)
+			}
+		}
+		if last := segments[len(segments)-1]; last.end != len(data) {
+			t.Errorf("segment size %d: segments end at %d, want %d", size, last.end, len(data))
+		}
+	}
+}
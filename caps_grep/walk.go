@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var followFlag bool
+var oneFileSystemFlag bool
+
+// a folder reached again through a symbolic link to one of the folders above it
+var errDirectoryLoop = errors.New("recursive directory loop")
+
+// the most folders waiting to be walked, once there are this many a walker walks the folders it finds itself
+const folderQueueSize = 1024
+
+// a walk of the files and folders to search, shared by the search methods
+type searchWalk struct {
+	ctx     context.Context
+	ordered bool                         // walk the folders one at a time so files are found in path order
+	found   func(path string)            // called with each file to search
+	failed  func(path string, err error) // called with each file or folder that could not be looked at
+	queue   chan folderJob               // folders waiting for a walker when the walk is not ordered
+	pending sync.WaitGroup               // folders that are in the queue or being walked from it
+}
+
+// a folder to walk, with the ignore rules of the folders above it and where it sits in the walk
+type folderJob struct {
+	path          string
+	parentIgnores *ignoreMatcher
+	walkPath      walkPath
+}
+
+// walk the paths given to search, the arguments to the program or the list on standard input, calling
+// found with each file to search and failed with each file or folder that can not be looked at, until
+// the context is cancelled. Unless the walk is ordered the folders are walked by a fixed number of walker
+// routines taking them from a queue, so found and failed can be called from more than one routine at once.
+func walkSearchPaths(ctx context.Context, ordered bool, found func(path string), failed func(path string, err error)) {
+	walk := &searchWalk{ctx: ctx, ordered: ordered, found: found, failed: failed}
+
+	var walkersWg sync.WaitGroup
+	if false == ordered {
+		walk.queue = make(chan folderJob, folderQueueSize)
+		for i := 0; i < cpuCount; i++ {
+			walkersWg.Add(1)
+			go walk.walker(&walkersWg)
+		}
+	}
+
+	err := eachSearchPath(ctx, func(root string) {
+		if root == stdinArg {
+			found(root)
+			return
+		}
+
+		// links given as arguments are always followed
+		rootInfo, err := os.Stat(root)
+		if err != nil {
+			failed(root, err)
+			return
+		}
+
+		if false == rootInfo.IsDir() {
+			if includeFile(root) {
+				found(root)
+			}
+			return
+		}
+
+		// a list of files from find also lists the folders they are in
+		if typeFlag != "files" {
+			walk.addFolder(folderJob{root, newRootIgnoreMatcher(root), newWalkPath(rootInfo)})
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		failed(stdinPath, err)
+	}
+
+	// once every folder is walked no more can be found, so let the walkers finish
+	if false == ordered {
+		walk.pending.Wait()
+		close(walk.queue)
+		walkersWg.Wait()
+	}
+}
+
+// routine that walks the folders in the queue until it is closed
+func (walk *searchWalk) walker(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for job := range walk.queue {
+		walk.walkFolder(job)
+		walk.pending.Done()
+	}
+}
+
+// walk a folder now if the walk is ordered, otherwise queue it for a walker, or walk it in this
+// routine if the queue is full
+func (walk *searchWalk) addFolder(job folderJob) {
+	if walk.ordered {
+		walk.walkFolder(job)
+		return
+	}
+
+	walk.pending.Add(1)
+	select {
+	case walk.queue <- job:
+	default:
+		walk.pending.Done()
+		walk.walkFolder(job)
+	}
+}
+
+// list a folder, calling found with its files and adding its sub folders to the walk
+func (walk *searchWalk) walkFolder(job folderJob) {
+	if walk.ctx.Err() != nil {
+		return
+	}
+
+	entries, err := os.ReadDir(job.path)
+	ignores := job.parentIgnores.forDir(job.path)
+
+	// note anything that can not be looked at and carry on with the rest of the walk
+	if err != nil {
+		walk.failed(job.path, err)
+	}
+
+	for _, entry := range entries {
+		if walk.ctx.Err() != nil {
+			return
+		}
+
+		path := filepath.Join(job.path, entry.Name())
+		kind, childWalkPath, err := job.walkPath.visitEntry(path, entry)
+		if err != nil {
+			walk.failed(path, err)
+			continue
+		}
+
+		// skip the folders and files that are excluded or ignored
+		switch kind {
+		case dirEntry:
+			if includeDir(path) && false == ignores.ignored(path, true) {
+				walk.addFolder(folderJob{path, ignores, childWalkPath})
+			}
+		case fileEntry:
+			if includeFile(path) && false == ignores.ignored(path, false) {
+				walk.found(path)
+			}
+		}
+	}
+}
+
+// what the walk does with an entry of a folder
+type entryKind int
+
+const (
+	skipEntry entryKind = iota
+	fileEntry
+	dirEntry
+)
+
+// identity of a file on disk, a folder reached through a symbolic link has the same one as the folder itself
+type fileID struct {
+	device uint64
+	inode  uint64
+}
+
+// where a folder being walked sits, the device the walk started on for -one-file-system
+// and the folders above it so -follow does not go round a loop of links forever
+type walkPath struct {
+	device    uint64
+	ancestors []fileID
+}
+
+func newWalkPath(rootInfo os.FileInfo) walkPath {
+	id, _ := fileIdentity(rootInfo)
+	return walkPath{device: id.device, ancestors: []fileID{id}}
+}
+
+// decide what to do with the entry of a folder found at "path", giving the walkPath of the entry when it
+// is a folder to walk into. Symbolic links are skipped unless -follow is given, then they are treated as
+// whatever they point at. Only regular files are searched, opening a named pipe could wait forever for
+// something to write to it and sockets or devices hold nothing to search.
+func (wp walkPath) visitEntry(path string, entry os.DirEntry) (entryKind, walkPath, error) {
+	var info os.FileInfo
+	var err error
+
+	if entry.Type()&os.ModeSymlink != 0 {
+		if false == followFlag {
+			return skipEntry, wp, nil
+		}
+		info, err = os.Stat(path)
+	} else if entry.Type().IsRegular() {
+		return fileEntry, wp, nil
+	} else if false == entry.IsDir() {
+		return skipEntry, wp, nil
+	} else if false == followFlag && false == oneFileSystemFlag {
+		return dirEntry, wp, nil
+	} else {
+		info, err = entry.Info()
+	}
+
+	if err != nil {
+		return skipEntry, wp, err
+	}
+	if info.Mode().IsRegular() {
+		return fileEntry, wp, nil
+	}
+	if false == info.IsDir() {
+		return skipEntry, wp, nil
+	}
+
+	id, _ := fileIdentity(info)
+	if oneFileSystemFlag && id.device != wp.device {
+		return skipEntry, wp, nil
+	}
+	if false == followFlag {
+		return dirEntry, wp, nil
+	}
+
+	for _, ancestor := range wp.ancestors {
+		if ancestor == id {
+			return skipEntry, wp, errDirectoryLoop
+		}
+	}
+	// cap the slice so folders next to each other never share the space they append into
+	child := walkPath{device: wp.device, ancestors: append(wp.ancestors[:len(wp.ancestors):len(wp.ancestors)], id)}
+	return dirEntry, child, nil
+}
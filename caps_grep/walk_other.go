@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// without device and inode numbers loops of links and other devices can not be spotted,
+// so -follow and -one-file-system are only allowed on unix systems
+const fileIdentitySupported = false
+
+func fileIdentity(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}